@@ -0,0 +1,101 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/retinadata/govip/vip"
+	"golang.org/x/sys/unix"
+)
+
+// check runs the validations and connects to the backend without campaigning
+// or touching any address, printing a line per check. It returns the exit
+// code, exitFailure if any check failed.
+func check(ctx context.Context, groups []groupConfig) int {
+	failed := false
+	report := func(err error, format string, a ...interface{}) {
+		what := fmt.Sprintf(format, a...)
+		if err != nil {
+			failed = true
+			fmt.Printf("FAIL %v: %v\n", what, err)
+			return
+		}
+		fmt.Printf("ok   %v\n", what)
+	}
+
+	errs := validate(groups)
+	for _, err := range errs {
+		report(err, "options")
+	}
+	if len(errs) == 0 {
+		report(nil, "options")
+	}
+
+	if !*observer && !*dryRun {
+		report(capability(unix.CAP_NET_ADMIN, "cap_net_admin"), "CAP_NET_ADMIN to set addresses")
+		report(capability(unix.CAP_NET_RAW, "cap_net_raw"), "CAP_NET_RAW to send gratuitous ARPs")
+	}
+
+	backend, closeBackend, err := newBackend(ctx)
+	report(err, "%v client", *backendName)
+	if err != nil {
+		return exitFailure
+	}
+	defer closeBackend()
+	ctx, cancel := context.WithTimeout(ctx, *dialTimeout+*reqTimeout)
+	defer cancel()
+	s, err := backend.NewSession(ctx)
+	report(err, "%v session", backend)
+	if err != nil {
+		return exitFailure
+	}
+	defer s.Close()
+	for _, g := range groups {
+		name := g.prefix
+		if g.label != "" {
+			name = g.label
+		}
+		leader, err := s.Election(g.prefix).Leader(ctx)
+		switch {
+		case err == vip.ErrNoLeader:
+			report(nil, "election %v, no leader", name)
+		case err != nil:
+			report(err, "election %v", name)
+		default:
+			report(nil, "election %v, %v is the leader", name, vip.ParseCandidate(leader).Member)
+		}
+	}
+
+	if failed {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// capability returns an error unless c, named name, is in the effective
+// capabilities of the process.
+func capability(c int, name string) error {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return err
+	}
+	if data[c/32].Effective&(1<<uint(c%32)) == 0 {
+		return fmt.Errorf("missing, run as root or grant %v", name)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the options read from a YAML config file. Keys are the flag
+// names, so everything that can be given on the command line can be given in
+// the file as well. The groups key lists groups of VIPs, see configGroups.
+type Config map[string]interface{}
+
+func readConfig(path string) (Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// An empty file, or one with only comments, sets nothing
+	c := Config{}
+	if err := yaml.NewDecoder(f).Decode(&c); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// setFlags returns the names of the flags given on the command line.
+func setFlags() map[string]bool {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// envName returns the environment variable that can set the named flag, e.g.
+// GOVIP_ARP_COUNT for -arp-count.
+func envName(name string) string {
+	return "GOVIP_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnv sets the flags that aren't in explicit from their environment
+// variables and adds them to explicit.
+func applyEnv(explicit map[string]bool) error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || f.Name == "version" {
+			return
+		}
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if serr := f.Value.Set(v); serr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", v, envName(f.Name), serr)
+			return
+		}
+		explicit[f.Name] = true
+	})
+	return err
+}
+
+// fromConfig holds the flags the config file set when it was last applied,
+// to tell them from the ones left at their defaults.
+var fromConfig = map[string]bool{}
+
+// applyConfig sets the flags from the config file at path, except the ones in
+// explicit.
+func applyConfig(path string, explicit map[string]bool) error {
+	c, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	set := map[string]bool{}
+
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "groups" {
+			continue
+		}
+		if k == "config" || k == "version" || flag.Lookup(k) == nil {
+			return fmt.Errorf("%s: unknown option %q", path, k)
+		}
+		if explicit[k] {
+			continue
+		}
+		v, err := configValue(c[k])
+		if err != nil {
+			return fmt.Errorf("%s: option %q: %v", path, k, err)
+		}
+		if err := flag.Set(k, v); err != nil {
+			return fmt.Errorf("%s: invalid value %q for option %q: %v", path, v, k, err)
+		}
+		set[k] = true
+	}
+	fromConfig = set
+	return nil
+}
+
+// configValue converts a YAML value to its flag representation. Lists are
+// joined with commas, like -vip and -etcd expect.
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, i := range v {
+			s, err := configValue(i)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case Config:
+		return "", fmt.Errorf("unexpected mapping")
+	case nil:
+		return "", nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a config file with content and returns its path. The
+// flags and fromConfig are restored when the test ends.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	before := flagValues()
+	names := make([]string, 0, len(before))
+	for name := range before {
+		names = append(names, name)
+	}
+	t.Cleanup(func() {
+		restoreFlags(before, names...)
+		fromConfig = map[string]bool{}
+	})
+	path := filepath.Join(t.TempDir(), "govip.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := writeConfig(t, "arp-count: 9\narp-interval: 3s\nvif: eth9\nvip:\n  - 10.0.0.1/32\n  - 10.0.0.2/32\n")
+	// Given on the command line
+	flag.Set("arp-count", "7")
+	explicit := map[string]bool{"arp-count": true}
+	t.Setenv("GOVIP_ARP_COUNT", "8")
+	t.Setenv("GOVIP_ARP_INTERVAL", "2s")
+
+	if err := applyEnv(explicit); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(path, explicit); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"arp-count":    "7",
+		"arp-interval": "2s",
+		"vif":          "eth9",
+		"vip":          "10.0.0.1/32,10.0.0.2/32",
+	} {
+		if got := flag.Lookup(name).Value.String(); got != want {
+			t.Errorf("-%v = %q, want %q", name, got, want)
+		}
+	}
+	if !explicit["arp-interval"] || explicit["vif"] {
+		t.Errorf("explicit = %v, want the options from the environment only", explicit)
+	}
+	if !fromConfig["vif"] || !fromConfig["vip"] || fromConfig["arp-count"] || fromConfig["arp-interval"] {
+		t.Errorf("fromConfig = %v, want vif and vip", fromConfig)
+	}
+}
+
+func TestConfigEnvInvalid(t *testing.T) {
+	writeConfig(t, "")
+	t.Setenv("GOVIP_ARP_COUNT", "many")
+	if err := applyEnv(map[string]bool{}); err == nil || !strings.Contains(err.Error(), "GOVIP_ARP_COUNT") {
+		t.Errorf("applyEnv: %v, want an error naming GOVIP_ARP_COUNT", err)
+	}
+}
+
+func TestConfigEmpty(t *testing.T) {
+	for _, content := range []string{"", "\n", "# nothing set yet\n"} {
+		path := writeConfig(t, content)
+		c, err := readConfig(path)
+		if err != nil || c == nil || len(c) != 0 {
+			t.Errorf("readConfig(%q) = %v, %v, want an empty Config", content, c, err)
+		}
+		if err := applyConfig(path, map[string]bool{}); err != nil {
+			t.Errorf("applyConfig(%q): %v", content, err)
+		}
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for _, tt := range []struct{ content, err string }{
+		{"vif:\n  name: eth0\n", `option "vif": unexpected mapping`},
+		{"vip:\n  - addr: 10.0.0.1/32\n", `option "vip": unexpected mapping`},
+		{"no-such-option: 1\n", `unknown option "no-such-option"`},
+		{"config: other.yaml\n", `unknown option "config"`},
+		{"version: true\n", `unknown option "version"`},
+		{"arp-count: many\n", `invalid value "many" for option "arp-count"`},
+		{"- vif\n", "cannot unmarshal"},
+	} {
+		path := writeConfig(t, tt.content)
+		if err := applyConfig(path, map[string]bool{}); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("applyConfig(%q): %v, want an error containing %q", tt.content, err, tt.err)
+		}
+	}
+}
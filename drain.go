@@ -0,0 +1,74 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/retinadata/govip/vip"
+)
+
+// drain sets the drain flag of the groups, or clears it if undo is set, so
+// that their leaders release the VIPs and no member campaigns until it is
+// cleared. With an argument only the group of that name is drained. It
+// prints a line per group and returns the exit code, exitFailure if any flag
+// couldn't be changed.
+func drain(ctx context.Context, groups []groupConfig, args []string, undo bool) int {
+	command := "drain"
+	if undo {
+		command = "undrain"
+	}
+	if len(args) > 1 {
+		fmt.Printf("usage: govip %s [flags] [GROUP]\n", command)
+		return exitConfig
+	}
+	if len(args) == 1 {
+		var ok bool
+		if groups, ok = pickGroups(groups, args[0]); !ok {
+			fmt.Printf("FAIL unknown group %q\n", args[0])
+			return exitConfig
+		}
+	}
+
+	backend, closeBackend, err := newBackend(ctx)
+	if err != nil {
+		fmt.Printf("FAIL %v client: %v\n", *backendName, err)
+		return exitFailure
+	}
+	defer closeBackend()
+	d, ok := backend.(vip.Drainer)
+	if !ok {
+		fmt.Printf("FAIL the %v backend can't keep a drain flag\n", backend)
+		return exitFailure
+	}
+	code := exitOK
+	for _, g := range groups {
+		name := groupName(g)
+		key := drainKey(g)
+		if key == "" {
+			fmt.Printf("FAIL %v: the drain flag would be below the candidates, end -name with /\n", name)
+			code = exitFailure
+			continue
+		}
+		if err := d.SetDrain(ctx, key, !undo); err != nil {
+			fmt.Printf("FAIL %s %v: %v\n", command, name, err)
+			code = exitFailure
+			continue
+		}
+		fmt.Printf("ok   %v %sed\n", name, command)
+	}
+	return code
+}
@@ -0,0 +1,429 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/retinadata/govip/vip"
+)
+
+// groupOptions are the options a group in the config file can set, all the
+// others are shared by the groups.
+var groupOptions = map[string]bool{
+	"name":          true,
+	"vip":           true,
+	"vip6":          true,
+	"vip-range":     true,
+	"vif":           true,
+	"vif-backup":    true,
+	"arp-vif":       true,
+	"arp-source-ip": true,
+	"addr-label":    true,
+	"priority":      true,
+	"on-acquire":    true,
+	"on-release":    true,
+	"status-file":   true,
+	"virtual-mac":   true,
+}
+
+// groupConfig is a group of VIPs with its own election.
+type groupConfig struct {
+	// label names the group in logs and metrics, it is empty when the
+	// flags define the only group.
+	label      string
+	prefix     string
+	vips       []string
+	vips6      []string
+	vipRange   string
+	vif        string
+	vifBackup  string
+	arpVif     string
+	arpSource  string
+	addrLabel  string
+	priority   int
+	onAcquire  string
+	onRelease  string
+	statusFile string
+	virtualMAC string
+	// vipSet tells a -vip that was given from one left at its default.
+	vipSet bool
+}
+
+// flagGroup returns the group defined by the flags. Flags in explicit were
+// given on the command line or the environment.
+func flagGroup(explicit map[string]bool) groupConfig {
+	return groupConfig{
+		prefix:     groupPrefix(*prefix),
+		vips:       strings.Split(*vips, ","),
+		vipSet:     explicit["vip"] || fromConfig["vip"],
+		vips6:      splitVIPs(*vips6),
+		vipRange:   *vipRange,
+		vif:        *vif,
+		vifBackup:  *vifBackup,
+		arpVif:     *arpVif,
+		arpSource:  *arpSource,
+		addrLabel:  *addrLabel,
+		priority:   *priority,
+		onAcquire:  *onAcquire,
+		onRelease:  *onRelease,
+		statusFile: *statusFile,
+		virtualMAC: *virtualMAC,
+	}
+}
+
+// groupPrefix returns name with a leading and trailing / when
+// -normalize-name is set. It is off by default as it moves the election of a
+// name like "govip" from govip/ to /govip//, members that don't agree on it
+// all elect their own leader.
+func groupPrefix(name string) string {
+	if !*normName {
+		return name
+	}
+	return "/" + strings.Trim(name, "/") + "/"
+}
+
+// configGroups returns the groups listed under groups in the config file at
+// path, or nil if there are none. Options a group doesn't set are taken from
+// the flags, see flagGroup.
+func configGroups(path string, explicit map[string]bool) ([]groupConfig, error) {
+	c, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := c["groups"]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: option \"groups\": expected a list", path)
+	}
+	groups := make([]groupConfig, 0, len(list))
+	for i, item := range list {
+		// yaml decodes the mappings inside a Config as Configs
+		opts, ok := item.(Config)
+		if !ok {
+			return nil, fmt.Errorf("%s: group %d: expected a mapping", path, i+1)
+		}
+		if _, ok := opts["name"]; !ok {
+			return nil, fmt.Errorf("%s: group %d: no name", path, i+1)
+		}
+		keys := make([]string, 0, len(opts))
+		for k := range opts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		g := flagGroup(explicit)
+		for _, k := range keys {
+			if !groupOptions[k] {
+				return nil, fmt.Errorf("%s: group %d: option %q can't be set per group", path, i+1, k)
+			}
+			v, err := configValue(opts[k])
+			if err != nil {
+				return nil, fmt.Errorf("%s: group %d: option %q: %v", path, i+1, k, err)
+			}
+			if err := g.set(k, v); err != nil {
+				return nil, fmt.Errorf("%s: group %d: invalid value %q for option %q: %v", path, i+1, v, k, err)
+			}
+		}
+		g.label = strings.Trim(g.prefix, "/")
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+func (g *groupConfig) set(name, value string) error {
+	switch name {
+	case "name":
+		g.prefix = groupPrefix(value)
+	case "vip":
+		g.vips = strings.Split(value, ",")
+		g.vipSet = true
+	case "vip6":
+		g.vips6 = splitVIPs(value)
+	case "vip-range":
+		g.vipRange = value
+	case "vif":
+		g.vif = value
+	case "vif-backup":
+		g.vifBackup = value
+	case "arp-vif":
+		g.arpVif = value
+	case "arp-source-ip":
+		g.arpSource = value
+	case "addr-label":
+		g.addrLabel = value
+	case "priority":
+		p, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		g.priority = p
+	case "on-acquire":
+		g.onAcquire = value
+	case "on-release":
+		g.onRelease = value
+	case "status-file":
+		g.statusFile = value
+	case "virtual-mac":
+		g.virtualMAC = value
+	}
+	return nil
+}
+
+// addrs returns the VIPs of g: -vip, -vip6 and the addresses of -vip-range.
+// -vip is left out when it wasn't given and either of the others is, even if
+// it was given with its default value.
+func (g groupConfig) addrs() ([]string, error) {
+	var vips []string
+	if g.vipSet || g.vipRange == "" && len(g.vips6) == 0 {
+		vips = append(vips, g.vips...)
+	}
+	vips = append(vips, g.vips6...)
+	if g.vipRange != "" {
+		r, err := expandRange(g.vipRange)
+		if err != nil {
+			return nil, err
+		}
+		vips = append(vips, r...)
+	}
+	return vips, nil
+}
+
+// arpVifs returns the interfaces listed by -arp-vif.
+func (g groupConfig) arpVifs() []string {
+	var ifaces []string
+	for _, s := range splitVIPs(g.arpVif) {
+		ifaces = append(ifaces, strings.TrimSpace(s))
+	}
+	return ifaces
+}
+
+// splitVIPs splits the comma separated list s, which may be empty.
+func splitVIPs(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// promoteKey returns the key govip promote puts the promoted member of g
+// under, see groupKey.
+func promoteKey(g groupConfig) string {
+	return groupKey(g, "promote")
+}
+
+// drainKey returns the key govip drain sets the drain flag of g under, see
+// groupKey.
+func drainKey(g groupConfig) string {
+	return groupKey(g, "drain")
+}
+
+// groupKey returns the key called name next to the candidates of g, or an
+// empty string if it would be below them because the name doesn't end with
+// /.
+func groupKey(g groupConfig, name string) string {
+	key := strings.TrimSuffix(g.prefix, "/") + "/" + name
+	if strings.HasPrefix(key, g.prefix+"/") {
+		return ""
+	}
+	return key
+}
+
+// groupName returns the label of g, or its prefix if it has none.
+func groupName(g groupConfig) string {
+	if g.label != "" {
+		return g.label
+	}
+	return g.prefix
+}
+
+// pickGroups returns the groups labelled label, or all of them if label is
+// empty. It returns false if there are none.
+func pickGroups(groups []groupConfig, label string) ([]groupConfig, bool) {
+	if label == "" {
+		return groups, true
+	}
+	var found []groupConfig
+	for _, g := range groups {
+		if g.label == label {
+			found = append(found, g)
+		}
+	}
+	return found, len(found) > 0
+}
+
+// notifiers returns the notifiers of -notify-webhook and -notify-slack.
+func notifiers() []vip.Notifier {
+	var ns []vip.Notifier
+	if *notifyHook != "" {
+		for _, u := range strings.Split(*notifyHook, ",") {
+			ns = append(ns, vip.WebhookNotifier{URL: strings.TrimSpace(u)})
+		}
+	}
+	if *notifySlack != "" {
+		for _, u := range strings.Split(*notifySlack, ",") {
+			ns = append(ns, vip.SlackNotifier{URL: strings.TrimSpace(u)})
+		}
+	}
+	return ns
+}
+
+// virtualName returns the name of the macvlan interface for -virtual-mac,
+// vmac followed by the last two bytes of mac.
+func virtualName(mac net.HardwareAddr) string {
+	return fmt.Sprintf("vmac%02x%02x", mac[len(mac)-2], mac[len(mac)-1])
+}
+
+// netNamespace is the network namespace of -netns, nil to manage the VIPs in
+// that of govip. The backend, APIs and metrics stay in the latter either way.
+var netNamespace *vip.Netns
+
+// netLinker returns the NetLinker the Managers set the VIPs through.
+func netLinker() vip.NetLinker {
+	if netNamespace != nil {
+		return netNamespace
+	}
+	return vip.Netlink{}
+}
+
+// inNamespace runs fn in the network namespace of -netns, if any, so the
+// interfaces it looks up are those the VIPs go on.
+func inNamespace(fn func()) error {
+	if netNamespace == nil {
+		fn()
+		return nil
+	}
+	return netNamespace.Do(func() error {
+		fn()
+		return nil
+	})
+}
+
+// group is a running group of VIPs.
+type group struct {
+	groupConfig
+	m *vip.Manager
+	r *vip.Runner
+}
+
+// newGroup creates the Manager and Runner of g, the options that aren't set
+// per group are taken from the flags.
+func newGroup(g groupConfig, backend vip.Backend) (*group, error) {
+	iface := g.vif
+	var mac net.HardwareAddr
+	if g.virtualMAC != "" {
+		mac, _ = net.ParseMAC(g.virtualMAC)
+		iface = virtualName(mac)
+	}
+	vips, err := g.addrs()
+	if err != nil {
+		return nil, err
+	}
+	m, err := vip.NewManagerWith(netLinker(), vips, iface)
+	if err != nil {
+		return nil, err
+	}
+	if mac != nil {
+		m.VirtualMAC = mac
+		m.Parent = g.vif
+	}
+	m.Group = g.label
+	m.BackupInterface = g.vifBackup
+	m.ARPCount = *arpCount
+	m.ARPInterval = *arpInterval
+	m.ARPDelay = *arpDelay
+	m.ARPType = *arpType
+	m.ARPInterfaces = g.arpVifs()
+	if g.arpSource != "" {
+		m.ARPSource = net.ParseIP(g.arpSource)
+	}
+	m.ARPMembers = *arpMembers
+	if *arpTargets != "" {
+		for _, t := range strings.Split(*arpTargets, ",") {
+			m.ARPTargets = append(m.ARPTargets, net.ParseIP(strings.TrimSpace(t)))
+		}
+	}
+	m.ARPIgnore = *arpIgnore
+	m.ARPAnnounce = *arpAnnounce
+	m.NoARP = *noARP
+	m.AddRoute = *addRoute
+	m.CreateInterface = *createVif
+	m.InterfaceType = *vifType
+	m.ConflictCheck = *conflict
+	m.ConflictTimeout = *conflictTO
+	m.Label = g.addrLabel
+	m.PreferredLifetime = *addrLft
+	m.NetlinkRetries = *nlRetries
+	m.NetlinkRetryInterval = *nlInterval
+	if m.Scope, err = vip.ParseScope(*addrScope); err != nil {
+		return nil, err
+	}
+	if *dryRun {
+		m.DryRun = true
+		m.Netlink = vip.NewDryRun(m.Netlink)
+	}
+
+	r := &vip.Runner{
+		Backend:            backend,
+		Manager:            m,
+		Prefix:             g.prefix,
+		Member:             *member,
+		Priority:           g.priority,
+		FailbackDelay:      *failback,
+		MinUptime:          *minUptime,
+		NoPreempt:          *noPreempt,
+		CampaignTimeout:    *campaignTO,
+		FenceTimeout:       *fenceTO,
+		SplitBrainInterval: *splitBrain,
+		SplitBrainRelease:  *sbRelease,
+		HandoffTimeout:     *handoffTO,
+		Observer:           *observer,
+		ElectionJitter:     *jitter,
+		RequestTimeout:     *reqTimeout,
+		ReconcileInterval:  *reconcile,
+		StallTimeout:       *stallTO,
+		ReaddLimit:         *readdLimit,
+		ReaddWindow:        *readdWindow,
+		ReaddResign:        *readdResign,
+		ARPOnStart:         *arpOnStart,
+		ARPRefreshInterval: *arpRefresh,
+		OnAcquire:          g.onAcquire,
+		OnRelease:          g.onRelease,
+		HookTimeout:        *hookTO,
+		StatusFile:         g.statusFile,
+		KeepOnExit:         *keepOnExit,
+	}
+	if *watchConfig {
+		r.ConfigKey = strings.TrimSuffix(g.prefix, "/") + "/config"
+	}
+	if _, ok := backend.(vip.Promoter); ok {
+		r.PromoteKey = promoteKey(g)
+	}
+	if _, ok := backend.(vip.Drainer); ok {
+		r.DrainKey = drainKey(g)
+	}
+	if *audit {
+		r.AuditPrefix = *auditPrefix
+		r.AuditTTL = *auditTTL
+	}
+	r.Notifiers = notifiers()
+	return &group{groupConfig: g, m: m, r: r}, nil
+}
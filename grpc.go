@@ -0,0 +1,123 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/retinadata/govip/api"
+	"github.com/retinadata/govip/vip"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer implements the gRPC API over the groups.
+type grpcServer struct {
+	api.UnimplementedGovipServer
+	groups []*group
+}
+
+// lookup returns the group called name, or all of them if name is empty.
+func (s *grpcServer) lookup(name string) ([]*group, error) {
+	if name == "" {
+		return s.groups, nil
+	}
+	for _, g := range s.groups {
+		if g.label == name {
+			return []*group{g}, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "unknown group %q", name)
+}
+
+func (s *grpcServer) GetStatus(ctx context.Context, req *api.GetStatusRequest) (*api.Status, error) {
+	groups, err := s.lookup(req.Group)
+	if err != nil {
+		return nil, err
+	}
+	g := groups[0]
+	st := &api.Status{
+		Group:         g.label,
+		Leader:        g.r.IsLeader(),
+		Vip:           g.m.String(),
+		Member:        g.r.Member,
+		CurrentLeader: g.r.Leader(),
+		Ready:         g.r.Ready(),
+		Paused:        g.r.Paused(),
+		HasVip:        g.r.HasVIP(),
+		ArpFailing:    g.r.ARPFailing(),
+	}
+	if st.Leader {
+		st.LeaderSeconds = time.Since(g.r.LeaderSince()).Seconds()
+	}
+	return st, nil
+}
+
+func (s *grpcServer) Resign(ctx context.Context, req *api.ResignRequest) (*api.ResignResponse, error) {
+	groups, err := s.lookup(req.Group)
+	if err != nil {
+		return nil, err
+	}
+	resigned := false
+	for _, g := range groups {
+		if err := g.r.Resign(); err == nil {
+			resigned = true
+		}
+	}
+	if !resigned {
+		return nil, status.Error(codes.FailedPrecondition, vip.ErrNotLeader.Error())
+	}
+	return &api.ResignResponse{}, nil
+}
+
+func (s *grpcServer) Pause(ctx context.Context, req *api.PauseRequest) (*api.PauseResponse, error) {
+	groups, err := s.lookup(req.Group)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		g.r.Pause()
+	}
+	return &api.PauseResponse{}, nil
+}
+
+func (s *grpcServer) Resume(ctx context.Context, req *api.ResumeRequest) (*api.ResumeResponse, error) {
+	groups, err := s.lookup(req.Group)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		g.r.Resume()
+	}
+	return &api.ResumeResponse{}, nil
+}
+
+func serveGRPC(addr string, groups []*group) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Errorf("gRPC server failed: %v", err)
+		return
+	}
+	srv := grpc.NewServer()
+	api.RegisterGovipServer(srv, &grpcServer{groups: groups})
+	log.Infof("Serving gRPC on %v", addr)
+	if err := srv.Serve(lis); err != nil {
+		log.Errorf("gRPC server failed: %v", err)
+	}
+}
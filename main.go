@@ -16,179 +16,692 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/j-keck/arping"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/retinadata/govip/vip"
 	log "github.com/sirupsen/logrus"
-	"github.com/vishvananda/netlink"
-	"go.etcd.io/etcd/client/v3/clientv3util"
-	"go.etcd.io/etcd/client/v3/concurrency"
-	"go.etcd.io/etcd/client/pkg/transport"
+	client "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/namespace"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 var (
 	Version     = "Not defined"
 	version     = flag.Bool("version", false, "Print version and exit")
+	logLevel    = flag.String("log-level", "info", "Log level: debug, info, warn or error, and component=level pairs for election, reconcile, arp or etcd, comma separated")
+	logFormat   = flag.String("log-format", "text", "Log format: text or json")
+	verbose     = flag.Bool("verbose", false, "Log at debug level, overriding the level of -log-level but not its components")
+	quiet       = flag.Bool("quiet", false, "Log at warn level, overriding the level of -log-level but not its components")
+	configFile  = flag.String("config", "", "YAML config file, options given on the command line override it")
 	prefix      = flag.String("name", "/govip/", "Position to synchronize multiple govips")
-	member      = flag.String("member", "hostname", "Unique name for this govip")
-	vip         = flag.String("vip", "192.168.0.254/32", "VIP to announce from the selected govip")
+	normName    = flag.Bool("normalize-name", false, "Give -name a leading and trailing / if it lacks them")
+	member      = flag.String("member", "", "Unique name for this govip, the hostname, machine ID or a MAC address if empty")
+	vips        = flag.String("vip", "192.168.0.254/32", "VIP(s) to announce from the selected govip, comma separated")
+	vips6       = flag.String("vip6", "", "IPv6 VIP(s) to announce along with -vip, comma separated")
+	vipRange    = flag.String("vip-range", "", "Prefixes or first-last ranges of VIPs to announce as single addresses along with -vip, comma separated")
 	vif         = flag.String("vif", "eth0", "Interface to announce the VIP from")
+	vifBackup   = flag.String("vif-backup", "", "Interface to move the VIP to while -vif has no carrier")
+	virtualMAC  = flag.String("virtual-mac", "", "MAC to put the VIP behind, on a macvlan interface of -vif that is only up on the leader")
+	createVif   = flag.Bool("create-interface", false, "Create the interface if it doesn't exist")
+	netnsName   = flag.String("netns", "", "Network namespace to manage the VIP in, a name in /run/netns or a path like /proc/PID/ns/net")
+	vifType     = flag.String("interface-type", "dummy", "Type of the interface to create")
+	conflict    = flag.Bool("conflict-check", false, "Refuse to set a VIP another host answers ARP requests for")
+	conflictTO  = flag.Duration("conflict-timeout", 1*time.Second, "Time to wait for an answer to the conflict check")
+	addrLabel   = flag.String("addr-label", "", "Label to set on the VIP, must start with the interface name")
+	addrScope   = flag.String("addr-scope", "global", "Scope of the VIP: global, site, link or host")
+	addRoute    = flag.Bool("add-route", false, "Add a route to the network of a VIP that isn't on-link on -vif while holding it")
+	addrLft     = flag.Duration("addr-preferred-lifetime", 0, "Preferred lifetime of the VIP, 0 for infinite")
+	dryRun      = flag.Bool("dry-run", false, "Take part in the election but only log changes to addresses, ARPs and hooks")
+	backendName = flag.String("backend", "etcd", "Backend to elect the leader in: etcd, consul or kubernetes")
+	consulAddr  = flag.String("consul", "", "Consul address, CONSUL_HTTP_ADDR or 127.0.0.1:8500 if empty")
+	consulToken = flag.String("consul-token", "", "Consul ACL token, CONSUL_HTTP_TOKEN if empty")
+	kubeconfig  = flag.String("kubeconfig", "", "kubeconfig file, the in-cluster config if empty")
+	kubeNS      = flag.String("kubernetes-namespace", "default", "Namespace of the Kubernetes Lease")
 	etcdaddress = flag.String("etcd", "https://127.0.0.1:2379", "etcd address(es)")
 	cafile      = flag.String("cacert", "ca.crt", "etcd CA cert")
 	certfile    = flag.String("cert", "server.crt", "etcd cert file")
 	keyfile     = flag.String("key", "server.key", "etcd key file")
+	dialSource  = flag.String("etcd-dial-source", "", "Local address or interface to connect to etcd from, e.g. on the management network")
+	dialTimeout = flag.Duration("etcd-dial-timeout", 5*time.Second, "Timeout to connect to etcd")
+	autoSync    = flag.Duration("etcd-auto-sync-interval", 0, "Interval to update the etcd addresses from the cluster membership, 0 to disable")
+	keepalive   = flag.Duration("etcd-keepalive-time", 0, "Idle time after which the etcd connection is probed with a gRPC keepalive ping, 0 to disable")
+	keepaliveTO = flag.Duration("etcd-keepalive-timeout", 0, "Time to wait for the answer to an -etcd-keepalive-time ping before the connection is closed, 20s if 0")
+	reqTimeout  = flag.Duration("etcd-request-timeout", 5*time.Second, "Timeout of etcd requests other than waiting to become the leader")
+	insecure    = flag.Bool("etcd-insecure", false, "Connect to etcd without TLS, implied when all etcd addresses are http://")
+	etcdUser    = flag.String("etcd-user", "", "etcd username")
+	etcdPass    = flag.String("etcd-password", "", "etcd password")
+	userFile    = flag.String("etcd-user-file", "", "File to read the etcd username from, overrides -etcd-user")
+	passFile    = flag.String("etcd-password-file", "", "File to read the etcd password from, overrides -etcd-password")
+	etcdNS      = flag.String("etcd-namespace", "", "Prefix put in front of every etcd key govip uses, to share etcd between clusters")
+	arpCount    = flag.Int("arp-count", 5, "Number of gratuitous ARPs to send after claiming the VIP, 0 to disable")
+	arpInterval = flag.Duration("arp-interval", 1*time.Second, "Interval between gratuitous ARPs")
+	arpType     = flag.String("arp-type", "request", "Gratuitous ARPs to send: request, reply or both")
+	arpDelay    = flag.Duration("arp-delay", 0, "Time between setting the VIP and sending the gratuitous ARPs, e.g. for services to bind to it")
+	arpVif      = flag.String("arp-vif", "", "Interfaces to send gratuitous ARPs from, comma separated, -vif if empty")
+	arpSource   = flag.String("arp-source-ip", "", "Sender address of the gratuitous ARPs, the VIP itself if empty")
+	arpTargets  = flag.String("arp-targets", "", "Peers, e.g. the gateway, to also send ARP requests from the VIP to after claiming it, comma separated")
+	arpMembers  = flag.String("arp-members", "active", "Members of a bond or bridge -vif to send gratuitous ARPs out: active, all or none to send on -vif itself")
+	arpIgnore   = flag.Int("arp-ignore", -1, "Value to set the arp_ignore sysctl of the interface the gratuitous ARPs go out to, -1 to leave it")
+	arpAnnounce = flag.Int("arp-announce", -1, "Value to set the arp_announce sysctl of the interface the gratuitous ARPs go out to, -1 to leave it")
+	noARP       = flag.Bool("noarp", false, "Set the NOARP flag on -vif so it doesn't answer ARP requests, e.g. for a VIP on loopback")
+	arpOnStart  = flag.Bool("arp-on-start", false, "Send gratuitous ARPs when first leading finds the VIP already set, e.g. after a crash")
+	arpRefresh  = flag.Duration("arp-refresh-interval", 0, "Interval to send a gratuitous ARP again while leader, 0 to disable")
+	priority    = flag.Int("priority", 0, "Priority to campaign with, the leader hands the VIP over to a member with a higher priority")
+	failback    = flag.Duration("failback-delay", 30*time.Second, "Time a member with a higher priority must wait in line before the leader hands the VIP over to it")
+	jitter      = flag.Float64("election-jitter", 0.2, "Fraction to randomize retry delays by, e.g. 0.2 for ±20%")
+	nlRetries   = flag.Int("netlink-retries", 3, "Number of times to retry a failed address change")
+	nlInterval  = flag.Duration("netlink-retry-interval", 200*time.Millisecond, "Time before the first netlink retry, doubled after each")
+	observer    = flag.Bool("observer", false, "Only follow the election and report the leader, never campaign or touch the VIP")
+	campaignTO  = flag.Duration("campaign-timeout", 30*time.Second, "Time after which a campaign is retried if there is no leader to wait for, 0 to wait forever")
+	minUptime   = flag.Duration("min-uptime", 0, "Time govip must have been running before it first campaigns")
+	noPreempt   = flag.Bool("no-preempt", false, "Only campaign while there is no leader instead of waiting in line behind it")
+	leaseTTL    = flag.Int("lease-ttl", 60, "Session TTL in seconds. Lower values fail over faster but are more sensitive to pauses and network jitter")
+	onAcquire   = flag.String("on-acquire", "", "Command to run after the VIP is set, with GOVIP_VIP and GOVIP_VIF in its environment")
+	onRelease   = flag.String("on-release", "", "Command to run after the VIP is released, with GOVIP_VIP and GOVIP_VIF in its environment")
+	hookTO      = flag.Duration("hook-timeout", 30*time.Second, "Time after which -on-acquire and -on-release commands are killed, 0 to wait for them")
+	healthCmd   = flag.String("health-check-cmd", "", "Command that must succeed for this govip to campaign, the leader steps down when it fails")
+	healthHTTP  = flag.String("health-check-http", "", "URL that must return a 2xx status for this govip to campaign")
+	healthTCP   = flag.String("health-check-tcp", "", "host:port that must accept connections for this govip to campaign")
+	gatewayIP   = flag.String("gateway-check", "", "IPv4 address, e.g. the gateway, that must answer ARP requests for this govip to campaign")
+	healthEvery = flag.Duration("health-check-interval", 5*time.Second, "Interval between health checks")
+	healthFails = flag.Int("health-check-threshold", 3, "Consecutive health check failures before stepping down")
+	audit       = flag.Bool("audit", false, "Record acquire, release and resign events in etcd")
+	auditPrefix = flag.String("audit-prefix", "/govip-events/", "etcd key prefix to record -audit events under")
+	auditTTL    = flag.Duration("audit-ttl", 7*24*time.Hour, "Time to keep -audit events for")
+	promoteTTL  = flag.Duration("promote-ttl", 10*time.Minute, "Time a member given to govip promote is preferred for")
+	notifyHook  = flag.String("notify-webhook", "", "URLs to post a JSON event to when the VIP is acquired or released, comma separated")
+	notifySlack = flag.String("notify-slack", "", "Slack incoming webhook URLs to post a message to when the VIP is acquired or released, comma separated")
+	watchConfig = flag.Bool("watch-config", false, "Follow the VIP and interface kept in <name>/config in etcd")
+	statusFile  = flag.String("status-file", "", "File to keep the leadership state in as JSON")
+	metricsAddr = flag.String("metrics-addr", "", "Address to serve Prometheus metrics on, e.g. :9090")
+	grpcAddr    = flag.String("grpc-addr", "", "Address to serve the gRPC control API on, e.g. 127.0.0.1:9091")
+	healthAddr  = flag.String("health-addr", "", "Address to serve /healthz, /readyz and /leader on, e.g. :8080")
+	splitBrain  = flag.Duration("split-brain-interval", 0, "Interval to ask the backend who leads while leader, to detect split brains, 0 to disable")
+	sbRelease   = flag.Bool("split-brain-release", false, "Release the VIP when -split-brain-interval finds another leader")
+	fenceTO     = flag.Duration("fence-on-quorum-loss", 0, "Release the VIP once etcd or the Kubernetes API hasn't confirmed the session for this long, e.g. without quorum, 0 to keep it")
+	keepOnExit  = flag.Bool("keep-ip-on-exit", false, "Leave the VIP set on exit for a restart on the same host, the leadership is still resigned")
+	handoffTO   = flag.Duration("graceful-handoff", 0, "Time to keep the VIP after resigning voluntarily until another member leads, 0 to release it right away")
+	shutdownTO  = flag.Duration("shutdown-timeout", 5*time.Second, "Time to wait for an orderly shutdown before releasing the VIP locally and exiting")
+	readdLimit  = flag.Int("readd-limit", 5, "Times the VIP may be set again within -readd-window before something is taken to be fighting over it, 0 to disable")
+	readdWindow = flag.Duration("readd-window", time.Minute, "Window for -readd-limit")
+	readdResign = flag.Bool("readd-resign", false, "Step down when -readd-limit is exceeded instead of setting the VIP again every -reconcile-interval")
+	reconcile   = flag.Duration("reconcile-interval", 10*time.Second, "Interval to check the VIP is still set while leader, 0 to disable")
+	stallTO     = flag.Duration("stall-timeout", 0, "Release the VIP and exit when setting or checking it hasn't made progress for this long, e.g. netlink hangs, 0 to disable")
 )
 
-func hasIP() (bool, *netlink.Addr, netlink.Link, error) {
-	vaddr, err := netlink.ParseAddr(*vip)
-	if err != nil {
-		return false, nil, nil, err
+// Exit codes, so a supervisor can tell failures worth a restart from the ones
+// a restart won't fix.
+const (
+	exitOK = 0
+	// exitFailure is any other failure, e.g. a shutdown that didn't finish
+	// within -shutdown-timeout
+	exitFailure = 1
+	// exitConfig is an invalid configuration
+	exitConfig = 2
+	// exitUnauthorized is the backend rejecting the credentials or
+	// permissions
+	exitUnauthorized = 3
+)
+
+// errConnect is wrapped by the errors of newBackend that come from reaching
+// the backend rather than from the options, which a restart may fix.
+var errConnect = errors.New("failed to connect")
+
+// backendExit returns the exit code for err from newBackend.
+func backendExit(err error) int {
+	switch {
+	case errors.Is(err, vip.ErrUnauthorized):
+		return exitUnauthorized
+	case errors.Is(err, errConnect):
+		return exitFailure
+	}
+	return exitConfig
+}
+
+// plainEndpoints reports whether all endpoints are plain http:// URLs.
+func plainEndpoints(endpoints []string) bool {
+	for _, ep := range endpoints {
+		if !strings.HasPrefix(ep, "http://") {
+			return false
+		}
+	}
+	return true
+}
+
+// etcdEndpoints returns the addresses given to -etcd.
+func etcdEndpoints() []string {
+	var endpoints []string
+	for _, ep := range strings.Split(*etcdaddress, ",") {
+		if ep = strings.TrimSpace(ep); ep != "" {
+			endpoints = append(endpoints, ep)
+		}
+	}
+	return endpoints
+}
+
+// etcdCredentials returns the etcd username and password, read from
+// -etcd-user-file and -etcd-password-file if given, without the trailing
+// newline secret files tend to end with.
+func etcdCredentials() (string, string, error) {
+	user, pass := *etcdUser, *etcdPass
+	for _, f := range []struct {
+		path  string
+		value *string
+	}{{*userFile, &user}, {*passFile, &pass}} {
+		if f.path == "" {
+			continue
+		}
+		b, err := os.ReadFile(f.path)
+		if err != nil {
+			return "", "", err
+		}
+		*f.value = strings.TrimRight(string(b), "\r\n")
 	}
-	vlink, err := netlink.LinkByName(*vif)
+	return user, pass, nil
+}
+
+// newBackend connects to the backend selected by -backend. The returned
+// function closes the connection.
+func newBackend(ctx context.Context) (vip.Backend, func() error, error) {
+	if *backendName == "consul" {
+		cfg := api.DefaultConfig()
+		if *consulAddr != "" {
+			cfg.Address = *consulAddr
+		}
+		if *consulToken != "" {
+			cfg.Token = *consulToken
+		}
+		c, err := api.NewClient(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		b := &vip.Consul{Client: c, TTL: time.Duration(*leaseTTL) * time.Second}
+		return b, func() error { return nil }, nil
+	}
+	if *backendName == "kubernetes" {
+		var (
+			cfg *rest.Config
+			err error
+		)
+		if *kubeconfig == "" {
+			cfg, err = rest.InClusterConfig()
+		} else {
+			cfg, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		c, err := kubernetes.NewForConfig(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		b := &vip.Kubernetes{
+			Client:        c,
+			Namespace:     *kubeNS,
+			LeaseDuration: time.Duration(*leaseTTL) * time.Second,
+		}
+		return b, func() error { return nil }, nil
+	}
+
+	user, pass, err := etcdCredentials()
 	if err != nil {
-		return false, nil, nil, err
+		return nil, nil, err
+	}
+	endpoints := etcdEndpoints()
+	var tlsConfig *tls.Config
+	if !*insecure && !plainEndpoints(endpoints) {
+		certs, err := newCertReloader(*certfile, *keyfile, *cafile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig = certs.clientConfig()
 	}
-	addrs, err := netlink.AddrList(vlink, netlink.FAMILY_ALL)
+	cli, err := dialEtcd(ctx, client.Config{
+		Endpoints:            endpoints,
+		AutoSyncInterval:     *autoSync,
+		DialTimeout:          *dialTimeout,
+		DialKeepAliveTime:    *keepalive,
+		DialKeepAliveTimeout: *keepaliveTO,
+		DialOptions:          etcdDialOptions(*dialSource),
+		TLS:                  tlsConfig,
+		Username:             user,
+		Password:             pass,
+	})
 	if err != nil {
-		return false, nil, nil, err
+		// With credentials the client authenticates, and so connects,
+		// before it is returned
+		if err = vip.EtcdError(err); errors.Is(err, vip.ErrUnauthorized) {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("%w to etcd: %v", errConnect, err)
+	}
+	if *etcdNS != "" {
+		cli.KV = namespace.NewKV(cli.KV, *etcdNS)
+		cli.Watcher = namespace.NewWatcher(cli.Watcher, *etcdNS)
+		cli.Lease = namespace.NewLease(cli.Lease, *etcdNS)
 	}
+	b := &vip.Etcd{Client: cli, LeaseTTL: *leaseTTL, RequestTimeout: *reqTimeout}
+	return b, cli.Close, nil
+}
 
-	for _, addr := range addrs {
-		if vaddr.Equal(addr) {
-			return true, vaddr, vlink, nil
-		}
+// dialEtcd creates the etcd client, giving up if ctx is cancelled while it
+// is still connecting. The client doesn't depend on ctx once created.
+func dialEtcd(ctx context.Context, cfg client.Config) (*client.Client, error) {
+	type result struct {
+		cli *client.Client
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		cli, err := client.New(cfg)
+		done <- result{cli, err}
+	}()
+	select {
+	case r := <-done:
+		return r.cli, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.err == nil {
+				r.cli.Close()
+			}
+		}()
+		return nil, ctx.Err()
 	}
-	return false, vaddr, vlink, nil
 }
 
-func releaseIP() error {
-	log.Debug("Releasing IP address")
-	set, vaddr, vlink, err := hasIP()
+// setupLogging applies -log-level, as level, with -verbose and -quiet, and the
+// log format.
+func setupLogging(level, format string) error {
+	global, levels, err := vip.ParseLogLevels(level)
 	if err != nil {
 		return err
 	}
-	if !set {
-		log.Debug("IP address not found")
-		return nil
+	switch {
+	case *verbose && *quiet:
+		return errors.New("-verbose and -quiet can't be used together")
+	case *verbose:
+		global = "debug"
+	case *quiet:
+		global = "warn"
+	case global == "":
+		global = "info"
 	}
-	if err := netlink.AddrDel(vlink, vaddr); err != nil {
+	l, err := log.ParseLevel(global)
+	if err != nil {
+		return err
+	}
+	if err := vip.SetLogLevels(levels); err != nil {
 		return err
 	}
-	log.Info("IP address released")
+	log.SetLevel(l)
+	switch format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
 	return nil
 }
 
-func ensureIP() (bool, error) {
-	log.Debug("Ensuring IP address")
-	set, vaddr, vlink, err := hasIP()
-	if err != nil {
-		return false, err
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Infof("Serving metrics on %v", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorf("Metrics server failed: %v", err)
 	}
-	if set {
-		log.Debug("IP address already set")
-		return false, nil
-	}
-	if err := netlink.AddrAdd(vlink, vaddr); err != nil {
-		return false, err
+}
+
+func serveHealth(addr string, groups []*group) {
+	check := func(ok func(r *vip.Runner) bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			for _, g := range groups {
+				if !ok(g.r) {
+					http.Error(w, "not ok", http.StatusServiceUnavailable)
+					return
+				}
+			}
+			fmt.Fprintln(w, "ok")
+		}
 	}
-	log.Info("IP address set, sending gratuitous ARPs")
-	for i := 0; i < 5; i++ {
-		arping.GratuitousArpOverIfaceByName(vaddr.IP, *vif)
-		time.Sleep(1 * time.Second)
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", check((*vip.Runner).Healthy))
+	mux.Handle("/readyz", check((*vip.Runner).Ready))
+	mux.HandleFunc("/leader", func(w http.ResponseWriter, req *http.Request) {
+		// The first group unless another one is asked for
+		g := groups[0]
+		if name := req.URL.Query().Get("group"); name != "" {
+			g = nil
+			for _, c := range groups {
+				if c.label == name {
+					g = c
+				}
+			}
+			if g == nil {
+				http.Error(w, "unknown group", http.StatusNotFound)
+				return
+			}
+		}
+		leader, err := g.r.QueryLeader(req.Context())
+		switch {
+		case err == vip.ErrNoLeader:
+			http.Error(w, "no leader", http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		default:
+			fmt.Fprintln(w, leader)
+		}
+	})
+	log.Infof("Serving health checks on %v", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorf("Health server failed: %v", err)
 	}
-
-	return true, nil
 }
 
 func main() {
-	flag.Parse()
+	// Signals are handled from the start, so a stop while still connecting
+	// to the backend doesn't wait for the dial
+	ctx, cancel := context.WithCancel(context.Background())
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	go handleSignals(signalChan, cancel)
+
+	// govip check [flags] validates the options and the backend connection
+	// and exits, govip release [flags] removes the VIPs from the interfaces
+	// and exits, govip promote [flags] MEMBER [GROUP] makes the leaders
+	// hand over to MEMBER and exits, govip drain [flags] [GROUP] and govip
+	// undrain [flags] [GROUP] set and clear the drain flag and exit
+	var command string
+	if len(os.Args) > 1 && isCommand(os.Args[1]) {
+		command = os.Args[1]
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
 	if *version {
 		fmt.Println(Version)
 		return
 	}
+	explicit := setFlags()
+	if err := applyEnv(explicit); err != nil {
+		fatal(exitConfig, err)
+	}
+	if *configFile != "" {
+		if err := applyConfig(*configFile, explicit); err != nil {
+			fatal(exitConfig, err)
+		}
+	}
 
-	releaseIP()
-	tlsInfo := transport.TLSInfo{
-		CertFile:      *certfile,
-		KeyFile:       *keyfile,
-		TrustedCAFile: *cafile,
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		fatal(exitConfig, err)
 	}
-	tlsConfig, err := tlsInfo.ClientConfig()
-	if err != nil {
-		log.Fatal(err)
+
+	if derived, err := resolveMember(); err != nil {
+		fatal(exitConfig, err)
+	} else if derived && command == "" {
+		log.Infof("Campaigning as member %v, set -member to choose another name", *member)
 	}
-	cli, err := client.New(client.Config{
-		Endpoints:   strings.Split(*etcdaddress, ","),
-		DialTimeout: 5 * time.Second,
-		TLS:         tlsConfig,
-	})
-	if err != nil {
-		log.Fatal(err)
+
+	configs := []groupConfig{flagGroup(explicit)}
+	if *configFile != "" {
+		c, err := configGroups(*configFile, explicit)
+		if err != nil {
+			fatal(exitConfig, err)
+		}
+		if c != nil {
+			configs = c
+		}
+	}
+	if *netnsName != "" {
+		ns, err := vip.OpenNetns(*netnsName)
+		if err != nil {
+			fatal(exitConfig, fmt.Errorf("-netns: %v", err))
+		}
+		netNamespace = ns
+	}
+	switch command {
+	case "check":
+		os.Exit(check(ctx, configs))
+	case "release":
+		os.Exit(release(configs))
+	case "promote":
+		os.Exit(promote(ctx, configs, flag.Args()))
+	case "drain", "undrain":
+		os.Exit(drain(ctx, configs, flag.Args(), command == "undrain"))
+	}
+	if errs := validate(configs); len(errs) > 0 {
+		for _, err := range errs {
+			log.Error(err)
+		}
+		fatal(exitConfig, fmt.Errorf("invalid configuration: %d errors", len(errs)))
 	}
-	defer cli.Close() // make sure to close the client
 
-	quit := make(chan int)
-	exit := make(chan int)
-	ctx, cancel := context.WithCancel(context.Background())
+	backend, closeBackend, err := newBackend(ctx)
+	if ctx.Err() != nil {
+		if err == nil {
+			closeBackend()
+		}
+		log.Info("Stopped before joining the election")
+		exitWith(exitOK)
+	}
+	if err != nil {
+		fatal(backendExit(err), err)
+	}
+	defer closeBackend() // make sure to close the client
 
-	go func() {
-		defer func() { exit <- 0 }()
-		s, err := concurrency.NewSession(cli)
+	var groups []*group
+	for _, c := range configs {
+		g, err := newGroup(c, backend)
 		if err != nil {
-			log.Fatal(err)
+			fatal(exitConfig, err)
+		}
+		groups = append(groups, g)
+	}
+	setStarted(groups)
+	// The groups share the health checks, the probes run once for all of
+	// them
+	if probes := healthProbes(); len(probes) > 0 {
+		health := &vip.HealthCheck{
+			Probes:    probes,
+			Interval:  *healthEvery,
+			Threshold: *healthFails,
 		}
-		defer s.Close()
+		for _, g := range groups {
+			g.r.Health = health
+		}
+		go health.Run(ctx)
+	}
 
-		e := concurrency.NewElection(s, *prefix)
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+	for _, g := range groups {
+		g.r.OnChange = func() { sdStatus(groups) }
+		g.r.OnStall = func() {
+			addExitReason("the reconcile loop stalled")
+			logSummary(groups)
+			exitWith(exitFailure)
+		}
+	}
+	if *healthAddr != "" {
+		go serveHealth(*healthAddr, groups)
+	}
+	if *grpcAddr != "" {
+		go serveGRPC(*grpcAddr, groups)
+	}
+	go sdWatchdog()
+	exit := make(chan int)
 
-		for {
-			select {
-			case <-time.After(5 * time.Second):
-				log.Debug("Waiting to become the leader")
-				err := e.Campaign(ctx, *member)
-				if err == context.Canceled {
-					return
-				}
-				if err != nil {
-					log.Fatal(err)
+	go func() {
+		var (
+			wg   sync.WaitGroup
+			mu   sync.Mutex
+			code = exitOK
+		)
+		for _, g := range groups {
+			wg.Add(1)
+			go func(r *vip.Runner) {
+				defer wg.Done()
+				if err := r.Run(ctx); err != nil {
+					log.Errorf("Giving up: %v", err)
+					addExitReason(err.Error())
+					mu.Lock()
+					code = exitFailure
+					if errors.Is(err, vip.ErrUnauthorized) {
+						code = exitUnauthorized
+					}
+					mu.Unlock()
+					cancel()
 				}
-				log.Debug("I am the leader")
+			}(g.r)
+		}
+		wg.Wait()
+		exit <- code
+	}()
 
-				res, err := ensureIP()
-				if err != nil {
-					log.Fatal(err)
-				}
-				if res {
-					defer releaseIP()
+	// SIGUSR1 toggles maintenance mode, SIGUSR2 always resumes
+	usrChan := make(chan os.Signal, 1)
+	signal.Notify(usrChan, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for s := range usrChan {
+			log.Infof("Received %v", s)
+			for _, g := range groups {
+				if s == syscall.SIGUSR1 && !g.r.Paused() {
+					g.r.Pause()
+				} else {
+					g.r.Resume()
 				}
-			case <-quit:
-				return
 			}
 		}
 	}()
-
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan,
-		syscall.SIGINT,
-		syscall.SIGTERM)
-
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
 	go func() {
-		for {
-			s := <-signalChan
-			log.Infof("Received %v", s)
-			cancel()
-			close(quit)
-			return
+		for range hupChan {
+			log.Info("Received hangup, reloading config")
+			reload(explicit, groups)
 		}
 	}()
 	code := <-exit
-	cli.Close()
+	closeBackend()
+	logSummary(groups)
+	exitWith(code)
+}
+
+// started holds the groups once they are set up, for handleSignals.
+var started struct {
+	sync.Mutex
+	groups []*group
+}
+
+func setStarted(groups []*group) {
+	started.Lock()
+	defer started.Unlock()
+	started.groups = groups
+}
+
+// isCommand reports whether arg names one of the commands that run instead of
+// the daemon.
+func isCommand(arg string) bool {
+	switch arg {
+	case "check", "release", "promote", "drain", "undrain":
+		return true
+	}
+	return false
+}
+
+// handleSignals stops govip on the first signal from sig by calling cancel,
+// which stops the groups or aborts the startup. If that doesn't finish
+// within -shutdown-timeout, or on a second signal, the VIPs of the groups
+// set up are released locally and govip exits.
+func handleSignals(sig <-chan os.Signal, cancel func()) {
+	s := <-sig
+	log.Infof("Received %v", s)
+	addExitReason("signal " + s.String())
+	sdNotify("STOPPING=1")
+	cancel()
+	// Releasing the VIPs doesn't need etcd, so it is done even if
+	// resigning or closing the session hangs
+	select {
+	case s := <-sig:
+		log.Warnf("Received %v again, exiting", s)
+	case <-time.After(*shutdownTO):
+		log.Warnf("Shutdown didn't finish within %v, exiting", *shutdownTO)
+	}
+	addExitReason("the shutdown didn't finish")
+	started.Lock()
+	groups := started.groups
+	started.Unlock()
+	if !*keepOnExit && len(groups) > 0 {
+		log.Info("Releasing the VIPs locally")
+		for _, g := range groups {
+			if err := g.m.Release(); err != nil {
+				log.Errorf("Failed to release the VIPs %v: %v", g.m, err)
+			}
+		}
+	}
+	logSummary(groups)
+	exitWith(exitFailure)
+}
+
+var (
+	exitMu     sync.Mutex
+	exitReason []string
+)
+
+// addExitReason records why govip is exiting, for logSummary.
+func addExitReason(reason string) {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	exitReason = append(exitReason, reason)
+}
+
+// logSummary logs what each group did during this run and why govip exits.
+func logSummary(groups []*group) {
+	exitMu.Lock()
+	reason := strings.Join(exitReason, ", ")
+	exitMu.Unlock()
+	for _, g := range groups {
+		s := g.r.Summary()
+		fields := log.Fields{
+			"leader":        s.Leader,
+			"terms":         s.Terms,
+			"leader_time":   s.LeaderTime.Round(time.Second).String(),
+			"readds":        s.Readds,
+			"arp_bursts":    s.ARPBursts,
+			"quorum_losses": s.QuorumLosses,
+			"reason":        reason,
+		}
+		if g.label != "" {
+			fields["group"] = g.label
+		}
+		log.WithFields(fields).Info("Shutdown summary")
+	}
+}
+
+func exitWith(code int) {
 	log.Infof("Exiting with code: %v", code)
 	os.Exit(code)
 }
+
+// fatal logs err and exits with code.
+func fatal(code int, err error) {
+	log.Error(err)
+	exitWith(code)
+}
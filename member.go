@@ -0,0 +1,61 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+)
+
+// resolveMember sets -member to defaultMember if it is empty, reporting
+// whether it did.
+func resolveMember() (bool, error) {
+	// "hostname" was the default before the name was derived
+	if *member != "" && *member != "hostname" {
+		return false, nil
+	}
+	name, err := defaultMember()
+	if err != nil {
+		return false, err
+	}
+	*member = name
+	return true, nil
+}
+
+// defaultMember derives a member name unique to this host: the hostname,
+// else the machine ID, else the MAC address of the first interface that has
+// one.
+func defaultMember() (string, error) {
+	if h, err := os.Hostname(); err == nil && h != "" && h != "localhost" && !strings.HasPrefix(h, "localhost.") {
+		return h, nil
+	}
+	if id, err := os.ReadFile("/etc/machine-id"); err == nil {
+		if id := strings.TrimSpace(string(id)); id != "" {
+			return id, nil
+		}
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 && len(iface.HardwareAddr) > 0 {
+			return strings.ReplaceAll(iface.HardwareAddr.String(), ":", ""), nil
+		}
+	}
+	return "", errors.New("can't derive a member name from the hostname, machine ID or a MAC address, set -member")
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/retinadata/govip/vip"
+)
+
+// promote asks the leaders of the groups to hand the leadership over to the
+// member named by args[0], for -promote-ttl. With a second argument only the
+// group of that name is promoted. It prints a line per group and returns the
+// exit code, exitFailure if any hint couldn't be written.
+func promote(ctx context.Context, groups []groupConfig, args []string) int {
+	if len(args) == 0 || len(args) > 2 {
+		fmt.Println("usage: govip promote [flags] MEMBER [GROUP]")
+		return exitConfig
+	}
+	member := args[0]
+	if *promoteTTL < time.Second {
+		fmt.Println("FAIL -promote-ttl must be at least 1s")
+		return exitConfig
+	}
+	if len(args) == 2 {
+		var ok bool
+		if groups, ok = pickGroups(groups, args[1]); !ok {
+			fmt.Printf("FAIL unknown group %q\n", args[1])
+			return exitConfig
+		}
+	}
+
+	backend, closeBackend, err := newBackend(ctx)
+	if err != nil {
+		fmt.Printf("FAIL %v client: %v\n", *backendName, err)
+		return exitFailure
+	}
+	defer closeBackend()
+	p, ok := backend.(vip.Promoter)
+	if !ok {
+		fmt.Printf("FAIL the %v backend can't pass promotion hints\n", backend)
+		return exitFailure
+	}
+	code := exitOK
+	for _, g := range groups {
+		name := groupName(g)
+		key := promoteKey(g)
+		if key == "" {
+			fmt.Printf("FAIL %v: the promotion hint would be below the candidates, end -name with /\n", name)
+			code = exitFailure
+			continue
+		}
+		if err := p.Promote(ctx, key, member, *promoteTTL); err != nil {
+			fmt.Printf("FAIL promoting %v in %v: %v\n", member, name, err)
+			code = exitFailure
+			continue
+		}
+		fmt.Printf("ok   %v promoted in %v for %v\n", member, name, *promoteTTL)
+	}
+	return code
+}
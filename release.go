@@ -0,0 +1,73 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// release removes the VIPs of the groups from their interfaces without
+// contacting the backend, for cleaning up after a govip that was killed. It
+// prints a line per VIP and returns the exit code, exitFailure if any
+// couldn't be checked or removed.
+func release(groups []groupConfig) int {
+	code := exitOK
+	for _, c := range groups {
+		g, err := newGroup(c, nil)
+		if err != nil {
+			vips := strings.Join(c.vips, ",")
+			if c.vipRange != "" {
+				vips = c.vipRange
+			}
+			fmt.Printf("FAIL %v: %v\n", vips, err)
+			code = exitFailure
+			continue
+		}
+		iface := g.m.InterfaceName()
+		set, _, err := g.m.Has()
+		if err != nil {
+			fmt.Printf("FAIL %v on %v: %v\n", g.m, iface, err)
+			code = exitFailure
+			continue
+		}
+		if !anySet(set) {
+			fmt.Printf("ok   %v not set on %v, nothing to do\n", g.m, iface)
+			continue
+		}
+		if err := g.m.Release(); err != nil {
+			fmt.Printf("FAIL releasing %v from %v: %v\n", g.m, iface, err)
+			code = exitFailure
+			continue
+		}
+		for i, a := range g.m.Addrs {
+			if set[i] {
+				fmt.Printf("ok   %v released from %v\n", a.IPNet, iface)
+			} else {
+				fmt.Printf("ok   %v not set on %v, nothing to do\n", a.IPNet, iface)
+			}
+		}
+	}
+	return code
+}
+
+func anySet(set []bool) bool {
+	for _, ok := range set {
+		if ok {
+			return true
+		}
+	}
+	return false
+}
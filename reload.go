@@ -0,0 +1,206 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/retinadata/govip/vip"
+	log "github.com/sirupsen/logrus"
+)
+
+// liveOptions can be changed by reloading the config file with SIGHUP, the
+// others need a restart.
+var liveOptions = map[string]bool{
+	"log-level":              true,
+	"log-format":             true,
+	"verbose":                true,
+	"quiet":                  true,
+	"arp-count":              true,
+	"arp-interval":           true,
+	"health-check-cmd":       true,
+	"health-check-http":      true,
+	"health-check-tcp":       true,
+	"gateway-check":          true,
+	"health-check-interval":  true,
+	"health-check-threshold": true,
+	"vip":                    true,
+	"vif":                    true,
+}
+
+func flagValues() map[string]string {
+	values := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) { values[f.Name] = f.Value.String() })
+	return values
+}
+
+func restoreFlags(values map[string]string, names ...string) {
+	for _, name := range names {
+		flag.Set(name, values[name])
+	}
+}
+
+// sameGroups reports whether the groups in c are the running ones.
+func sameGroups(c []groupConfig, groups []*group) bool {
+	if len(c) != len(groups) {
+		return false
+	}
+	for i, g := range groups {
+		if !reflect.DeepEqual(c[i], g.groupConfig) {
+			return false
+		}
+	}
+	return true
+}
+
+func healthProbes() []vip.Probe {
+	var probes []vip.Probe
+	if *healthCmd != "" {
+		probes = append(probes, vip.CommandProbe{Command: *healthCmd})
+	}
+	if *healthHTTP != "" {
+		probes = append(probes, vip.HTTPProbe{URL: *healthHTTP})
+	}
+	if *healthTCP != "" {
+		probes = append(probes, vip.TCPProbe{Address: *healthTCP})
+	}
+	if *gatewayIP != "" {
+		p := vip.ARPProbe{IP: net.ParseIP(*gatewayIP)}
+		if netNamespace != nil {
+			p.Namespace = netNamespace
+		}
+		probes = append(probes, p)
+	}
+	return probes
+}
+
+// reload reads the config file again and applies the options that can be
+// changed while running. Options in explicit were given on the command line
+// or the environment and keep their values.
+func reload(explicit map[string]bool, groups []*group) {
+	if *configFile == "" {
+		log.Warn("No config file to reload")
+		return
+	}
+	before := flagValues()
+	var names []string
+	flag.VisitAll(func(f *flag.Flag) {
+		names = append(names, f.Name)
+		if !explicit[f.Name] && f.Name != "config" {
+			f.Value.Set(f.DefValue)
+		}
+	})
+	if err := applyConfig(*configFile, explicit); err != nil {
+		log.Errorf("Failed to reload config: %v", err)
+		restoreFlags(before, names...)
+		return
+	}
+	if _, err := resolveMember(); err != nil {
+		log.Errorf("Failed to reload config: %v", err)
+		restoreFlags(before, names...)
+		return
+	}
+
+	// With groups in the config file -vip and -vif are only their defaults
+	configured := groups[0].label != ""
+
+	var changed []string
+	for name, v := range flagValues() {
+		if before[name] == v {
+			continue
+		}
+		// -vif is the parent of -virtual-mac and the primary -vif-backup
+		// follows the carrier of, neither of which can change live
+		pinned := name == "vif" && (*virtualMAC != "" || *vifBackup != "")
+		if !liveOptions[name] || configured && (name == "vip" || name == "vif") || pinned {
+			log.Warnf("%v changed from %q to %q, restart to apply it", name, before[name], v)
+			restoreFlags(before, name)
+			continue
+		}
+		changed = append(changed, name)
+	}
+	if c, err := configGroups(*configFile, explicit); err != nil || (c != nil) != configured || configured && !sameGroups(c, groups) {
+		log.Warn("groups changed, restart to apply them")
+	}
+	sort.Strings(changed)
+	if len(changed) == 0 {
+		log.Info("Reloaded config, nothing changed")
+		return
+	}
+	has := func(names ...string) bool {
+		for _, c := range changed {
+			for _, n := range names {
+				if c == n {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if has("log-level", "log-format", "verbose", "quiet") {
+		if err := setupLogging(*logLevel, *logFormat); err != nil {
+			log.Errorf("Failed to apply logging options: %v", err)
+			restoreFlags(before, "log-level", "log-format", "verbose", "quiet")
+			setupLogging(*logLevel, *logFormat)
+		}
+	}
+	if has("arp-count", "arp-interval") {
+		for _, g := range groups {
+			g.m.SetARP(*arpCount, *arpInterval)
+		}
+	}
+	if has("health-check-cmd", "health-check-http", "health-check-tcp", "gateway-check", "health-check-interval", "health-check-threshold") {
+		probes := healthProbes()
+		errs := validateHealth()
+		if groups[0].r.Health == nil || len(probes) == 0 {
+			log.Warn("Health checks can't be enabled or disabled live, restart to apply it")
+			restoreFlags(before, "health-check-cmd", "health-check-http", "health-check-tcp", "gateway-check", "health-check-interval", "health-check-threshold")
+		} else if len(errs) > 0 {
+			for _, err := range errs {
+				log.Errorf("Failed to apply health check options: %v", err)
+			}
+			restoreFlags(before, "health-check-cmd", "health-check-http", "health-check-tcp", "gateway-check", "health-check-interval", "health-check-threshold")
+		} else {
+			groups[0].r.Health.Update(probes, *healthEvery, *healthFails)
+		}
+	}
+	if has("vip", "vif") {
+		vips, _ := flagGroup(explicit).addrs()
+		// The VIPs stay on the interface they are on, e.g. that of
+		// -virtual-mac or -vif-backup, unless -vif changed
+		iface := groups[0].m.InterfaceName()
+		if has("vif") {
+			iface = *vif
+		}
+		if err := groups[0].m.Replace(vips, iface); err != nil {
+			log.Errorf("Failed to switch to the new VIP: %v", err)
+			restoreFlags(before, "vip", "vif")
+		}
+	}
+
+	var applied []string
+	after := flagValues()
+	for _, name := range changed {
+		if after[name] != before[name] {
+			applied = append(applied, name)
+		}
+	}
+	log.Infof("Reloaded config, applied: %v", strings.Join(applied, ", "))
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/retinadata/govip/vip"
+	log "github.com/sirupsen/logrus"
+)
+
+// sdNotify sends state to systemd as described in sd_notify(3). It does
+// nothing when not run by systemd with Type=notify.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		// Abstract namespace socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Debugf("Failed to notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Debugf("Failed to notify systemd: %v", err)
+	}
+}
+
+// sdStatus reports the state of the groups, the service is ready once all
+// of them are.
+func sdStatus(groups []*group) {
+	ready := true
+	states := make([]string, len(groups))
+	for i, g := range groups {
+		var ok bool
+		ok, states[i] = runnerStatus(g.r)
+		ready = ready && ok
+		if g.label != "" {
+			states[i] = g.label + ": " + states[i]
+		}
+	}
+	state := "STATUS=" + strings.Join(states, "; ")
+	if ready {
+		state = "READY=1\n" + state
+	}
+	sdNotify(state)
+}
+
+func runnerStatus(r *vip.Runner) (bool, string) {
+	switch {
+	case !r.Ready():
+		return false, "Not connected"
+	case r.IsLeader() && !r.HasVIP():
+		return true, fmt.Sprintf("Leader, %v not set", r.Manager)
+	case r.IsLeader() && r.ARPFailing():
+		return true, fmt.Sprintf("Leader, holding %v but the gratuitous ARPs failed", r.Manager)
+	case r.IsLeader():
+		return true, fmt.Sprintf("Leader, holding %v", r.Manager)
+	case r.HasVIP():
+		return true, fmt.Sprintf("Standby, still holding %v", r.Manager)
+	case r.Leader() != "":
+		return true, fmt.Sprintf("Standby, %v is the leader", r.Leader())
+	default:
+		return true, "Standby"
+	}
+}
+
+// sdWatchdog pings the systemd watchdog at half its interval if it is
+// enabled for this process.
+func sdWatchdog() {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	t := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer t.Stop()
+	for range t.C {
+		sdNotify("WATCHDOG=1")
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certReloader reads the etcd client certificate, key and CA bundle again
+// whenever one of the files changes, so rotated certificates are used
+// without a restart.
+type certReloader struct {
+	certFile, keyFile, caFile string
+
+	mu       sync.Mutex
+	modTimes [3]time.Time
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+}
+
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the files again if any of them changed since the last time.
+// On errors the previous certificates are kept.
+func (c *certReloader) reload() error {
+	var modTimes [3]time.Time
+	for i, f := range []string{c.certFile, c.keyFile, c.caFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[i] = fi.ModTime()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if modTimes == c.modTimes {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	ca, err := ioutil.ReadFile(c.caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("%s: no certificates found", c.caFile)
+	}
+	if c.cert != nil {
+		log.Info("Reloaded etcd client certificates")
+	}
+	c.cert, c.pool, c.modTimes = &cert, pool, modTimes
+	return nil
+}
+
+func (c *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	if err := c.reload(); err != nil {
+		log.Warnf("Failed to reload etcd client certificates, keeping the previous ones: %v", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, c.pool
+}
+
+// clientConfig returns a TLS config using the current certificates on every
+// handshake.
+func (c *certReloader) clientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := c.current()
+			return cert, nil
+		},
+		// The server certificate is verified in VerifyConnection, against
+		// the current CA bundle instead of a fixed RootCAs
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("no server certificate")
+			}
+			_, pool := c.current()
+			opts := x509.VerifyOptions{
+				DNSName:       cs.ServerName,
+				Roots:         pool,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}
+}
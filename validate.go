@@ -0,0 +1,470 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/retinadata/govip/vip"
+)
+
+// validate checks the options for mistakes that would otherwise only show up
+// deep in netlink or etcd, returning all of them.
+func validate(groups []groupConfig) []error {
+	var errs []error
+	errorf := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	prefixes := map[string]string{}
+	addrs := map[string]string{}
+	virtuals := map[string]string{}
+	statusFiles := map[string]bool{}
+	for _, g := range groups {
+		var groupErrs []error
+		if err := inNamespace(func() { groupErrs = validateGroup(g) }); err != nil {
+			groupErrs = append(groupErrs, fmt.Errorf("-netns: %v", err))
+		}
+		for _, err := range groupErrs {
+			if g.label != "" {
+				err = fmt.Errorf("group %v: %v", g.label, err)
+			}
+			errs = append(errs, err)
+		}
+		// Groups are told apart by their label in logs and metrics, which
+		// drops the slashes around the name
+		if other, ok := prefixes[g.label]; ok && other == g.prefix {
+			errorf("group %v: the name %q is used by another group", g.label, g.prefix)
+		} else if ok {
+			errorf("group %v: the names %q and %q of two groups are both shown as %v", g.label, other, g.prefix, g.label)
+		} else {
+			prefixes[g.label] = g.prefix
+		}
+		vips, _ := g.addrs()
+		for _, v := range vips {
+			ip, _, err := net.ParseCIDR(strings.TrimSpace(v))
+			if err != nil {
+				continue
+			}
+			if other, ok := addrs[ip.String()]; ok {
+				errorf("group %v: VIP %v is also in group %v", g.label, ip, other)
+			}
+			addrs[ip.String()] = g.label
+		}
+		if mac, err := net.ParseMAC(g.virtualMAC); err == nil {
+			if other, ok := virtuals[virtualName(mac)]; ok {
+				errorf("group %v: the virtual MAC %v needs the same interface, %v, as group %v", g.label, mac, virtualName(mac), other)
+			}
+			virtuals[virtualName(mac)] = g.label
+			if *watchConfig {
+				errorf("group %v: -virtual-mac can't be used with -watch-config, which may move the VIP to another interface", g.label)
+			}
+		}
+		if g.statusFile != "" && statusFiles[g.statusFile] {
+			errorf("group %v: the status file %v is used by another group", g.label, g.statusFile)
+		}
+		statusFiles[g.statusFile] = true
+	}
+	if _, err := vip.ParseScope(*addrScope); err != nil {
+		errorf("-addr-scope: %v", err)
+	}
+	for _, n := range notifiers() {
+		switch n := n.(type) {
+		case vip.WebhookNotifier:
+			if !httpURL(n.URL) {
+				errorf("-notify-webhook: %q is not an http or https URL", n.URL)
+			}
+		case vip.SlackNotifier:
+			// A Slack webhook URL is a secret, it isn't shown
+			if !httpURL(n.URL) {
+				errorf("-notify-slack: not an http or https URL")
+			}
+		}
+	}
+
+	switch *backendName {
+	case "etcd":
+		errs = append(errs, validateEtcd()...)
+		errs = append(errs, validateKeys(groups)...)
+	case "consul":
+		if *leaseTTL < 10 {
+			errorf("-lease-ttl must be at least 10 seconds with Consul")
+		}
+	case "kubernetes":
+		if *leaseTTL < 6 {
+			errorf("-lease-ttl must be at least 6 seconds with Kubernetes")
+		}
+	default:
+		errorf("-backend: unknown backend %q, use etcd, consul or kubernetes", *backendName)
+	}
+	if *watchConfig && *backendName != "etcd" {
+		errorf("-watch-config is only supported with the etcd backend")
+	}
+	if *dialSource != "" && *backendName != "etcd" {
+		errorf("-etcd-dial-source is only supported with the etcd backend")
+	}
+	if *fenceTO != 0 && *backendName == "consul" {
+		errorf("-fence-on-quorum-loss is only supported with the etcd and kubernetes backends")
+	}
+	// The session is checked every quarter of it
+	if *fenceTO < 0 {
+		errorf("-fence-on-quorum-loss can't be negative")
+	} else if *fenceTO > 0 && *fenceTO < time.Second {
+		errorf("-fence-on-quorum-loss must be at least a second, or 0")
+	}
+	if *hookTO < 0 {
+		errorf("-hook-timeout can't be negative")
+	}
+	errs = append(errs, validateHealth()...)
+	if *readdLimit < 0 {
+		errorf("-readd-limit can't be negative")
+	}
+	if *readdLimit > 0 && *readdWindow <= 0 {
+		errorf("-readd-window must be positive")
+	}
+	if *splitBrain < 0 {
+		errorf("-split-brain-interval can't be negative")
+	}
+	if *sbRelease && *splitBrain == 0 {
+		errorf("-split-brain-release needs -split-brain-interval")
+	}
+	if *audit && *backendName != "etcd" {
+		errorf("-audit is only supported with the etcd backend")
+	}
+	if *audit && *auditTTL < time.Second {
+		errorf("-audit-ttl must be at least a second")
+	}
+	if *gatewayIP != "" {
+		if ip := net.ParseIP(*gatewayIP); ip == nil || ip.To4() == nil {
+			errorf("-gateway-check: %q is not an IPv4 address", *gatewayIP)
+		}
+	}
+	switch *arpMembers {
+	case vip.ARPMembersNone, vip.ARPMembersActive, vip.ARPMembersAll:
+	default:
+		errorf("-arp-members: unknown value %q, use active, all or none", *arpMembers)
+	}
+	switch *arpType {
+	case vip.ARPTypeRequest, vip.ARPTypeReply, vip.ARPTypeBoth:
+	default:
+		errorf("-arp-type: unknown value %q, use request, reply or both", *arpType)
+	}
+	if *arpIgnore < -1 || *arpIgnore > 8 {
+		errorf("-arp-ignore must be between 0 and 8, or -1")
+	}
+	if *arpAnnounce < -1 || *arpAnnounce > 2 {
+		errorf("-arp-announce must be between 0 and 2, or -1")
+	}
+	if *arpDelay < 0 {
+		errorf("-arp-delay can't be negative")
+	}
+	// Setting the VIPs sends the gratuitous ARPs before the loop runs again
+	if burst := time.Duration(*arpCount) * *arpInterval; *stallTO < 0 {
+		errorf("-stall-timeout can't be negative")
+	} else if *stallTO > 0 && *stallTO <= burst {
+		errorf("-stall-timeout must be longer than the %v the gratuitous ARPs take", burst)
+	}
+	if *nlRetries < 0 {
+		errorf("-netlink-retries can't be negative")
+	}
+	if *jitter < 0 || *jitter >= 1 {
+		errorf("-election-jitter must be at least 0 and less than 1")
+	}
+	return errs
+}
+
+// validateKeys checks that the etcd keys of the groups stay apart. The
+// candidates of a group are the keys below <name>/, anything else written
+// there, e.g. the config key of a name without a trailing /, would be taken
+// for one.
+func validateKeys(groups []groupConfig) []error {
+	var errs []error
+	errorf := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	overlap := func(a, b string) bool {
+		return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+	}
+	for i, g := range groups {
+		if strings.Trim(g.prefix, "/") == "" {
+			continue
+		}
+		keys := g.prefix + "/"
+		for _, o := range groups[i+1:] {
+			if o.label != g.label && overlap(keys, o.prefix+"/") {
+				errorf("group %v: the name %q overlaps %q of group %v", g.label, g.prefix, o.prefix, o.label)
+			}
+		}
+		if c := strings.TrimSuffix(g.prefix, "/") + "/config"; *watchConfig && strings.HasPrefix(c, keys) {
+			errorf("-name %q: the config key %v is below the candidates, end the name with /", g.prefix, c)
+		}
+		if *audit && overlap(keys, *auditPrefix) {
+			errorf("-audit-prefix %q overlaps the candidates of -name %q", *auditPrefix, g.prefix)
+		}
+	}
+	return errs
+}
+
+// validateGroup checks the options that can be set per group.
+func validateGroup(g groupConfig) []error {
+	var errs []error
+	errorf := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	if strings.Trim(g.prefix, "/") == "" {
+		errorf("-name can't be empty")
+	}
+	for _, v := range g.vips {
+		if _, _, err := net.ParseCIDR(strings.TrimSpace(v)); err != nil {
+			errorf("-vip: %q is not an address in CIDR notation, e.g. 192.168.0.254/32", v)
+		}
+	}
+	for _, v := range g.vips6 {
+		if ip, _, err := net.ParseCIDR(strings.TrimSpace(v)); err != nil || ip.To4() != nil {
+			errorf("-vip6: %q is not an IPv6 address in CIDR notation, e.g. fd00::254/128", v)
+		}
+	}
+	if _, err := g.addrs(); err != nil {
+		errorf("-vip-range: %v", err)
+	}
+	// An observer never touches the interfaces, they needn't exist
+	if _, err := net.InterfaceByName(g.vif); err != nil && !*createVif && !*observer {
+		errorf("-vif: %v: %v, use -create-interface to create it", g.vif, err)
+	}
+	if g.virtualMAC != "" {
+		if mac, err := net.ParseMAC(g.virtualMAC); err != nil || len(mac) != 6 {
+			errorf("-virtual-mac: %q is not a MAC address, e.g. 00:00:5e:00:01:01", g.virtualMAC)
+		} else if mac[0]&1 != 0 {
+			errorf("-virtual-mac: %v is a multicast address", mac)
+		}
+		switch {
+		case g.vifBackup != "":
+			errorf("-virtual-mac can't be used with -vif-backup")
+		case g.arpVif != "":
+			errorf("-virtual-mac can't be used with -arp-vif, the gratuitous ARPs must come from the virtual MAC")
+		case *createVif:
+			errorf("-virtual-mac can't be used with -create-interface, the macvlan interface is created on -vif")
+		}
+	}
+	if g.vifBackup != "" && !*observer {
+		if _, err := net.InterfaceByName(g.vifBackup); err != nil {
+			errorf("-vif-backup: %v: %v", g.vifBackup, err)
+		}
+		if g.vifBackup == g.vif {
+			errorf("-vif-backup must differ from -vif")
+		}
+		if g.addrLabel != "" {
+			errorf("-addr-label can't be used with -vif-backup, the label must start with the interface name")
+		}
+	}
+	if g.arpVif != "" && !*observer {
+		seen := map[string]bool{}
+		for _, name := range g.arpVifs() {
+			if seen[name] {
+				errorf("-arp-vif: %v is listed twice", name)
+				continue
+			}
+			seen[name] = true
+			if _, err := net.InterfaceByName(name); err != nil {
+				errorf("-arp-vif: %q: %v", name, err)
+			}
+		}
+	}
+	if *noARP && g.arpVif == "" && *arpCount > 0 {
+		errorf("-noarp needs -arp-vif to send the gratuitous ARPs from, or -arp-count 0")
+	}
+	if g.arpSource != "" {
+		if err := validateOnLink(g, g.arpSource); err != nil {
+			errorf("-arp-source-ip: %v", err)
+		}
+	}
+	if *arpTargets != "" {
+		for _, t := range strings.Split(*arpTargets, ",") {
+			if err := validateOnLink(g, t); err != nil {
+				errorf("-arp-targets: %v", err)
+			}
+		}
+	}
+	if g.addrLabel != "" && !strings.HasPrefix(g.addrLabel, g.vif) {
+		errorf("-addr-label: %q must start with the interface name %q", g.addrLabel, g.vif)
+	}
+	return errs
+}
+
+// validateHealth checks the health check options, reload checks them again
+// before applying them.
+func validateHealth() []error {
+	var errs []error
+	errorf := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	// The interval is also the timeout of a round of probes
+	if *healthEvery <= 0 {
+		errorf("-health-check-interval must be positive")
+	}
+	if *healthFails < 1 {
+		errorf("-health-check-threshold must be at least 1")
+	}
+	return errs
+}
+
+// validateEtcd checks the options of the etcd backend.
+func validateEtcd() []error {
+	var errs []error
+	errorf := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	endpoints := etcdEndpoints()
+	if len(endpoints) == 0 {
+		errorf("-etcd: no etcd address given")
+	}
+	// The client connects to all endpoints with the credentials the first
+	// one needs
+	plain := 0
+	for _, ep := range endpoints {
+		if strings.HasPrefix(ep, "http://") {
+			plain++
+		}
+	}
+	if plain > 0 && plain < len(endpoints) {
+		errorf("-etcd: http:// addresses can't be mixed with TLS ones")
+	}
+	if ip := net.ParseIP(*dialSource); ip != nil {
+		if !localIP(ip) {
+			errorf("-etcd-dial-source: %v isn't an address of this host", ip)
+		}
+	} else if *dialSource != "" {
+		if _, err := net.InterfaceByName(*dialSource); err != nil {
+			errorf("-etcd-dial-source: %q is neither an IP address nor an interface: %v", *dialSource, err)
+		}
+	}
+	if *keepalive < 0 || *keepaliveTO < 0 {
+		errorf("-etcd-keepalive-time and -etcd-keepalive-timeout can't be negative")
+	}
+	if *keepaliveTO > 0 && *keepalive == 0 {
+		errorf("-etcd-keepalive-timeout needs -etcd-keepalive-time")
+	}
+	if *autoSync < 0 {
+		errorf("-etcd-auto-sync-interval can't be negative")
+	}
+	if !*insecure && !plainEndpoints(endpoints) {
+		for _, f := range []struct{ flag, path string }{
+			{"cacert", *cafile},
+			{"cert", *certfile},
+			{"key", *keyfile},
+		} {
+			if err := readable(f.path); err != nil {
+				errorf("-%s: %v", f.flag, err)
+			}
+		}
+	}
+	for _, f := range []struct{ flag, path string }{
+		{"etcd-user-file", *userFile},
+		{"etcd-password-file", *passFile},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if err := readable(f.path); err != nil {
+			errorf("-%s: %v", f.flag, err)
+		}
+	}
+	if user, pass, err := etcdCredentials(); err == nil && pass != "" && user == "" {
+		errorf("an etcd password requires -etcd-user or -etcd-user-file")
+	}
+	return errs
+}
+
+// readable returns an error if the file at path can't be opened for reading.
+func readable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// validateOnLink checks s is an IPv4 address in a subnet of an interface
+// the gratuitous ARPs of g go out, or of a VIP.
+func validateOnLink(g groupConfig, s string) error {
+	ip := net.ParseIP(strings.TrimSpace(s))
+	if ip == nil || ip.To4() == nil {
+		return fmt.Errorf("%q is not an IPv4 address", s)
+	}
+	if *observer {
+		return nil
+	}
+	var nets []*net.IPNet
+	vips, _ := g.addrs()
+	for _, v := range vips {
+		if _, n, err := net.ParseCIDR(strings.TrimSpace(v)); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	names := []string{g.vif}
+	if g.arpVif != "" {
+		names = g.arpVifs()
+	}
+	for _, name := range names {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok {
+				nets = append(nets, n)
+			}
+		}
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%v is in no subnet of %v or the VIPs", ip, strings.Join(names, ", "))
+}
+
+// localIP reports whether ip is set on an interface of this host.
+func localIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpURL reports whether s is an absolute http or https URL.
+func httpURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	client "go.etcd.io/etcd/client/v3"
+)
+
+// Auditor is implemented by backends that can keep a history of events that
+// expires on its own.
+type Auditor interface {
+	// Audit stores value under a new key below prefix, sorting after the
+	// earlier ones, for ttl.
+	Audit(ctx context.Context, prefix string, value []byte, ttl time.Duration) error
+}
+
+// Audit stores value below prefix with a lease of ttl. Keys are the time in
+// nanoseconds, so a range read returns the events in order.
+func (b *Etcd) Audit(ctx context.Context, prefix string, value []byte, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, b.requestTimeout())
+	defer cancel()
+	lease, err := b.Client.Grant(ctx, int64(ttl/time.Second))
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s%020d", prefix, time.Now().UnixNano())
+	_, err = b.Client.Put(ctx, key, string(value), client.WithLease(lease.ID))
+	return err
+}
+
+// audit records event in the audit history if AuditPrefix is set. It doesn't
+// wait for the write so failovers aren't slowed down by it.
+func (r *Runner) audit(event string) {
+	if r.AuditPrefix == "" {
+		return
+	}
+	a, ok := r.Backend.(Auditor)
+	if !ok {
+		return
+	}
+	value, err := json.Marshal(struct {
+		Time   time.Time `json:"time"`
+		Member string    `json:"member"`
+		Event  string    `json:"event"`
+		VIP    string    `json:"vip"`
+	}{time.Now().UTC(), r.Member, event, r.Manager.String()})
+	if err != nil {
+		return
+	}
+	go func() {
+		if err := a.Audit(context.Background(), r.AuditPrefix, value, r.AuditTTL); err != nil {
+			r.logger().Warnf("Failed to record %v event: %v", event, err)
+		}
+	}()
+}
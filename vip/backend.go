@@ -0,0 +1,73 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNoLeader is returned when nobody holds the leadership.
+var ErrNoLeader = errors.New("no leader elected")
+
+// ErrUnauthorized is wrapped by the errors of backends that rejected the
+// credentials or permissions, which retrying won't fix.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// ErrNotLeader is returned by Runner.Resign when the runner doesn't lead.
+var ErrNotLeader = errors.New("not the leader")
+
+// Backend is a store the members elect their leader in, such as etcd or
+// Consul.
+type Backend interface {
+	// NewSession starts a session that keeps this member's place in its
+	// elections until it is closed or expires.
+	NewSession(ctx context.Context) (Session, error)
+	// String returns the name of the backend for logs.
+	String() string
+}
+
+// Session is the liveness of a member in a Backend. Its leadership and place
+// in line go with it.
+type Session interface {
+	// Election returns the election at prefix.
+	Election(prefix string) Election
+	// Done is closed when the session expires or is closed.
+	Done() <-chan struct{}
+	Close() error
+}
+
+// Election elects one leader among the members campaigning at a prefix.
+type Election interface {
+	// Campaign blocks until the leadership is won with value, which is
+	// what the others observe, or ctx is cancelled.
+	Campaign(ctx context.Context, value string) error
+	// Resign gives up the leadership if held.
+	Resign(ctx context.Context) error
+	// Observe sends the value of the leader now and whenever it changes,
+	// an empty string while there is none, until ctx is cancelled.
+	Observe(ctx context.Context) <-chan string
+	// Leader returns the value of the current leader or ErrNoLeader.
+	Leader(ctx context.Context) (string, error)
+}
+
+// Queue is implemented by elections whose candidates wait in line behind
+// the leader, which allows handing over to a candidate with a higher
+// priority.
+type Queue interface {
+	// Waiting sends the values of the candidates in line behind the
+	// leader now and whenever they change, until ctx is cancelled.
+	Waiting(ctx context.Context) <-chan []string
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Candidate is a member taking part in the election, as stored in the value
+// of its election key.
+type Candidate struct {
+	Member   string `json:"member"`
+	Priority int    `json:"priority"`
+	// PID and Started identify the govip process, they are zero in values
+	// written by older versions.
+	PID     int       `json:"pid,omitempty"`
+	Started time.Time `json:"started"`
+}
+
+// processStart is when this process started, as far as Started is concerned.
+var processStart = time.Now().UTC().Truncate(time.Second)
+
+// String returns the campaign value of c, a JSON document.
+func (c Candidate) String() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return c.Member
+	}
+	return string(b)
+}
+
+// ParseCandidate parses a campaign value written by Candidate.String. Values
+// written by older versions, a member name optionally followed by
+// ";priority=N", are accepted as well.
+func ParseCandidate(s string) Candidate {
+	if strings.HasPrefix(s, "{") {
+		var c Candidate
+		if err := json.Unmarshal([]byte(s), &c); err == nil {
+			return c
+		}
+	}
+	if i := strings.LastIndex(s, ";priority="); i >= 0 {
+		if p, err := strconv.Atoi(s[i+len(";priority="):]); err == nil {
+			return Candidate{Member: s[:i], Priority: p}
+		}
+	}
+	return Candidate{Member: s}
+}
+
+func (r *Runner) candidate() Candidate {
+	return Candidate{
+		Member:   r.Member,
+		Priority: r.Priority,
+		PID:      os.Getpid(),
+		Started:  processStart,
+	}
+}
+
+// self reports whether c, read back from the election, was campaigned with by
+// this process.
+func (r *Runner) self(c Candidate) bool {
+	return c.Member == r.Member && c.PID == os.Getpid() && c.Started.Equal(processStart)
+}
+
+// higherWaiting reports whether a candidate with a higher priority than this
+// member is waiting in line.
+func (r *Runner) higherWaiting(ctx context.Context, e Election) bool {
+	q, ok := e.(Queue)
+	if !ok {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.requestTimeout())
+	defer cancel()
+	for _, v := range <-q.Waiting(ctx) {
+		if ParseCandidate(v).Priority > r.Priority {
+			return true
+		}
+	}
+	return false
+}
+
+// failback returns a channel that receives a candidate with a higher priority
+// once it has been waiting in line behind this leader for FailbackDelay, but
+// not while this member is promoted. It gives up when ctx is cancelled, and
+// is nil if the election has no line.
+func (r *Runner) failback(ctx context.Context, e Election) <-chan Candidate {
+	q, ok := e.(Queue)
+	if !ok {
+		return nil
+	}
+	ch := make(chan Candidate, 1)
+	go func() {
+		// Candidates are told apart by their value, a member that
+		// leaves the line and comes back starts waiting anew
+		since := map[string]time.Time{}
+		waiting := q.Waiting(ctx)
+		var t *time.Timer
+		defer func() {
+			if t != nil {
+				t.Stop()
+			}
+		}()
+		for {
+			var (
+				next  string
+				timer <-chan time.Time
+			)
+			for v, at := range since {
+				if next == "" || at.Before(since[next]) {
+					next = v
+				}
+			}
+			if t != nil {
+				t.Stop()
+			}
+			// A promoted leader keeps the leadership while promoted
+			promoted, promoteChanged := r.promotion()
+			if next != "" && promoted != r.Member {
+				t = time.NewTimer(time.Until(since[next].Add(r.FailbackDelay)))
+				timer = t.C
+			}
+			select {
+			case <-promoteChanged:
+			case <-timer:
+				ch <- ParseCandidate(next)
+				return
+			case values, ok := <-waiting:
+				if !ok {
+					return
+				}
+				seen := map[string]bool{}
+				for _, v := range values {
+					if ParseCandidate(v).Priority <= r.Priority {
+						continue
+					}
+					seen[v] = true
+					if _, ok := since[v]; !ok {
+						since[v] = time.Now()
+					}
+				}
+				for v := range since {
+					if !seen[v] {
+						delete(since, v)
+					}
+				}
+			}
+		}
+	}()
+	return ch
+}
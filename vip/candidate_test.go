@@ -0,0 +1,55 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/retinadata/govip/vip"
+)
+
+func TestParseCandidate(t *testing.T) {
+	started := time.Date(2026, 10, 14, 8, 29, 26, 0, time.UTC)
+	for _, tt := range []struct {
+		in   string
+		want vip.Candidate
+	}{
+		{`{"member":"node1","priority":10,"pid":42,"started":"2026-10-14T08:29:26Z"}`, vip.Candidate{Member: "node1", Priority: 10, PID: 42, Started: started}},
+		{`{"member":"node1","priority":0,"started":"0001-01-01T00:00:00Z"}`, vip.Candidate{Member: "node1"}},
+		// Written by older versions
+		{"node1", vip.Candidate{Member: "node1"}},
+		{"node1;priority=10", vip.Candidate{Member: "node1", Priority: 10}},
+		{"node1;priority=-5", vip.Candidate{Member: "node1", Priority: -5}},
+		{"a;b;priority=3", vip.Candidate{Member: "a;b", Priority: 3}},
+		// Anything else is taken for a member name
+		{"", vip.Candidate{}},
+		{"node1;priority=high", vip.Candidate{Member: "node1;priority=high"}},
+		{`{"member":`, vip.Candidate{Member: `{"member":`}},
+		{`{"member":5}`, vip.Candidate{Member: `{"member":5}`}},
+	} {
+		got := vip.ParseCandidate(tt.in)
+		if got.Member != tt.want.Member || got.Priority != tt.want.Priority || got.PID != tt.want.PID || !got.Started.Equal(tt.want.Started) {
+			t.Errorf("ParseCandidate(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCandidateString(t *testing.T) {
+	c := vip.Candidate{Member: "node1;priority=1", Priority: 7, PID: 42, Started: time.Date(2026, 10, 14, 8, 29, 26, 0, time.UTC)}
+	if got := vip.ParseCandidate(c.String()); got != c {
+		t.Errorf("ParseCandidate(%v) = %+v, want %+v", c, got, c)
+	}
+}
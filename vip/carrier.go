@@ -0,0 +1,76 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"context"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// followCarrier moves the VIPs to BackupInterface while the interface they
+// were on when it was called has no carrier, and back once it has again,
+// until ctx is cancelled. Only the addresses move, the leadership is kept.
+func (m *Manager) followCarrier(ctx context.Context) {
+	primary, backup := m.InterfaceName(), m.BackupInterface
+	for attempt := 0; ctx.Err() == nil; {
+		wctx, cancel := context.WithCancel(ctx)
+		updates := make(chan netlink.LinkUpdate)
+		if err := m.Netlink.LinkSubscribe(updates, wctx.Done()); err != nil {
+			cancel()
+			m.logger().Warnf("Failed to watch the carrier of %v: %v", primary, err)
+			if !sleep(ctx, backoff(attempt)) {
+				return
+			}
+			attempt++
+			continue
+		}
+		attempt = 0
+		// Changes before subscribing would be missed otherwise
+		if link, err := m.Netlink.LinkByName(primary); err == nil {
+			m.switchInterface(primary, backup, hasCarrier(link))
+		}
+		for u := range updates {
+			if u.Link.Attrs().Name == primary {
+				m.switchInterface(primary, backup, hasCarrier(u.Link))
+			}
+		}
+		cancel()
+	}
+}
+
+// switchInterface moves the VIPs to backup if primary has no carrier, or
+// back to primary if it has.
+func (m *Manager) switchInterface(primary, backup string, carrier bool) {
+	current := m.InterfaceName()
+	switch {
+	case !carrier && current == primary:
+		m.logger().Warnf("%v has no carrier, moving the IP addresses to %v", primary, backup)
+		if err := m.Replace(strings.Split(m.String(), ","), backup); err != nil {
+			m.logger().Errorf("Failed to move the IP addresses to %v: %v", backup, err)
+		}
+	case carrier && current == backup:
+		m.logger().Infof("%v has a carrier again, moving the IP addresses back", primary)
+		if err := m.Replace(strings.Split(m.String(), ","), primary); err != nil {
+			m.logger().Errorf("Failed to move the IP addresses to %v: %v", primary, err)
+		}
+	}
+}
+
+func hasCarrier(link netlink.Link) bool {
+	return link.Attrs().RawFlags&unix.IFF_LOWER_UP != 0
+}
@@ -0,0 +1,197 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Consul is the Backend using Consul sessions and locks. The leader holds
+// the lock on a key named leader below the prefix; there is no line to wait
+// in, whoever acquires the lock first after it is released leads.
+type Consul struct {
+	Client *api.Client
+	// TTL is the TTL of the session, between 10 seconds and 24 hours.
+	TTL time.Duration
+}
+
+func (b *Consul) String() string {
+	return "Consul"
+}
+
+// NewSession creates a session and keeps renewing it until it is closed.
+func (b *Consul) NewSession(ctx context.Context) (Session, error) {
+	id, _, err := b.Client.Session().Create(&api.SessionEntry{
+		Name:     "govip",
+		TTL:      b.TTL.String(),
+		Behavior: api.SessionBehaviorRelease,
+	}, (&api.WriteOptions{}).WithContext(ctx))
+	var serr api.StatusError
+	if errors.As(err, &serr) && serr.Code == http.StatusForbidden {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &consulSession{
+		client: b.Client,
+		id:     id,
+		done:   make(chan struct{}),
+		stop:   make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		// RenewPeriodic destroys the session once stop is closed
+		err := b.Client.Session().RenewPeriodic(b.TTL.String(), id, nil, s.stop)
+		if err != nil {
+			log.Warnf("Consul session %v ended: %v", id, err)
+		}
+	}()
+	return s, nil
+}
+
+type consulSession struct {
+	client *api.Client
+	id     string
+	done   chan struct{}
+	stop   chan struct{}
+	once   sync.Once
+}
+
+func (s *consulSession) Election(prefix string) Election {
+	return &consulElection{
+		session: s,
+		key:     strings.Trim(prefix, "/") + "/leader",
+	}
+}
+
+func (s *consulSession) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *consulSession) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	<-s.done
+	return nil
+}
+
+type consulElection struct {
+	session *consulSession
+	key     string
+}
+
+func (e *consulElection) Campaign(ctx context.Context, value string) error {
+	kv := e.session.client.KV()
+	pair := &api.KVPair{Key: e.key, Value: []byte(value), Session: e.session.id}
+	for {
+		ok, _, err := kv.Acquire(pair, (&api.WriteOptions{}).WithContext(ctx))
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if err := e.waitReleased(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// waitReleased blocks until nobody holds the lock.
+func (e *consulElection) waitReleased(ctx context.Context) error {
+	var index uint64
+	for {
+		pair, meta, err := e.session.client.KV().Get(e.key, (&api.QueryOptions{WaitIndex: index}).WithContext(ctx))
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+		if pair == nil || pair.Session == "" {
+			return nil
+		}
+		index = meta.LastIndex
+	}
+}
+
+func (e *consulElection) Resign(ctx context.Context) error {
+	pair := &api.KVPair{Key: e.key, Session: e.session.id}
+	_, _, err := e.session.client.KV().Release(pair, (&api.WriteOptions{}).WithContext(ctx))
+	return err
+}
+
+func (e *consulElection) Leader(ctx context.Context) (string, error) {
+	pair, _, err := e.session.client.KV().Get(e.key, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	if pair == nil || pair.Session == "" {
+		return "", ErrNoLeader
+	}
+	return string(pair.Value), nil
+}
+
+func (e *consulElection) Observe(ctx context.Context) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		var index uint64
+		sent, last := false, ""
+		for attempt := 0; ctx.Err() == nil; {
+			pair, meta, err := e.session.client.KV().Get(e.key, (&api.QueryOptions{WaitIndex: index}).WithContext(ctx))
+			if err != nil {
+				if !sleep(ctx, backoff(attempt)) {
+					return
+				}
+				attempt++
+				continue
+			}
+			attempt = 0
+			if meta.LastIndex < index {
+				// The index went backwards, e.g. after a restore
+				index = 0
+			} else {
+				index = meta.LastIndex
+			}
+			leader := ""
+			if pair != nil && pair.Session != "" {
+				leader = string(pair.Value)
+			}
+			if sent && leader == last {
+				continue
+			}
+			select {
+			case ch <- leader:
+			case <-ctx.Done():
+				return
+			}
+			sent, last = true, leader
+		}
+	}()
+	return ch
+}
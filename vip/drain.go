@@ -0,0 +1,107 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"context"
+)
+
+// Drainer is implemented by backends that can keep a drain flag, which tells
+// every member of an election to stay out of it, e.g. during maintenance of
+// the whole cluster.
+type Drainer interface {
+	// SetDrain sets the flag under key, or clears it if drain is false.
+	SetDrain(ctx context.Context, key string, drain bool) error
+	// WatchDrain sends whether the flag under key is set now and whenever
+	// that changes, until ctx is cancelled.
+	WatchDrain(ctx context.Context, key string) <-chan bool
+}
+
+// SetDrain puts true under key, or deletes it. Unlike a promotion hint the
+// flag has no lease, it stays until cleared.
+func (b *Etcd) SetDrain(ctx context.Context, key string, drain bool) error {
+	ctx, cancel := context.WithTimeout(ctx, b.requestTimeout())
+	defer cancel()
+	var err error
+	if drain {
+		_, err = b.Client.Put(ctx, key, "true")
+	} else {
+		_, err = b.Client.Delete(ctx, key)
+	}
+	return err
+}
+
+// WatchDrain watches key like WatchPromotion, the flag is set while it holds
+// true.
+func (b *Etcd) WatchDrain(ctx context.Context, key string) <-chan bool {
+	ch := make(chan bool)
+	go func() {
+		defer close(ch)
+		last := false
+		first := true
+		for value := range b.watchValue(ctx, key) {
+			drain := value == "true"
+			if drain == last && !first {
+				continue
+			}
+			select {
+			case ch <- drain:
+				last, first = drain, false
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// followDrain keeps the flag under DrainKey until ctx is cancelled.
+func (r *Runner) followDrain(ctx context.Context) {
+	defer r.setDrained(false)
+	d, ok := r.Backend.(Drainer)
+	if !ok {
+		r.logger().Warnf("The %v backend can't keep a drain flag, ignoring %v", r.Backend, r.DrainKey)
+		return
+	}
+	for drain := range d.WatchDrain(ctx, r.DrainKey) {
+		r.setDrained(drain)
+	}
+}
+
+func (r *Runner) setDrained(drained bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.drained == drained {
+		return
+	}
+	if drained {
+		r.logger().Info("Drained by an operator, not taking part in the election")
+	} else {
+		r.logger().Info("The drain is over, taking part in the election")
+	}
+	r.drained = drained
+	// Draining makes the runner ineligible
+	if r.pauseChanged != nil {
+		close(r.pauseChanged)
+		r.pauseChanged = nil
+	}
+}
+
+// Drained reports whether the drain flag is set.
+func (r *Runner) Drained() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.drained
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	client "go.etcd.io/etcd/client/v3"
+)
+
+// ConfigWatcher is implemented by backends that can keep the VIP assignment
+// for the runners to follow.
+type ConfigWatcher interface {
+	// WatchConfig sends the value of key, if it exists, and every new
+	// value put afterwards until ctx is cancelled.
+	WatchConfig(ctx context.Context, key string) <-chan []byte
+}
+
+// VIPConfig is the VIP assignment kept under the ConfigKey of a Runner, e.g.
+// {"vip": ["10.0.0.1/32"], "vif": "eth0"}. An empty interface keeps the
+// current one.
+type VIPConfig struct {
+	VIPs      []string `json:"vip"`
+	Interface string   `json:"vif"`
+}
+
+// WatchConfig watches key, getting it again after a failed watch. Deleting
+// the key sends nothing.
+func (b *Etcd) WatchConfig(ctx context.Context, key string) <-chan []byte {
+	ch := make(chan []byte)
+	go func() {
+		defer close(ch)
+		send := func(value []byte) bool {
+			select {
+			case ch <- value:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for attempt := 0; ctx.Err() == nil; {
+			gctx, cancel := context.WithTimeout(ctx, b.requestTimeout())
+			resp, err := b.Client.Get(gctx, key)
+			cancel()
+			if err != nil {
+				if !sleep(ctx, backoff(attempt)) {
+					return
+				}
+				attempt++
+				continue
+			}
+			attempt = 0
+			if len(resp.Kvs) > 0 && !send(resp.Kvs[0].Value) {
+				return
+			}
+			wctx, cancel := context.WithCancel(ctx)
+			for wresp := range b.Client.Watch(wctx, key, client.WithRev(resp.Header.Revision+1)) {
+				if wresp.Err() != nil {
+					break
+				}
+				for _, ev := range wresp.Events {
+					if ev.Type == client.EventTypePut && !send(ev.Kv.Value) {
+						cancel()
+						return
+					}
+				}
+			}
+			cancel()
+		}
+	}()
+	return ch
+}
+
+// watchConfig applies the assignments under ConfigKey until ctx is
+// cancelled.
+func (r *Runner) watchConfig(ctx context.Context) {
+	w, ok := r.Backend.(ConfigWatcher)
+	if !ok {
+		r.logger().Warnf("The %v backend can't keep the VIP config, ignoring %v", r.Backend, r.ConfigKey)
+		return
+	}
+	for value := range w.WatchConfig(ctx, r.ConfigKey) {
+		if err := r.applyConfig(value); err != nil {
+			r.logger().Errorf("Ignoring invalid config in %v: %v", r.ConfigKey, err)
+		}
+	}
+}
+
+// applyConfig validates the assignment in value and switches to it.
+func (r *Runner) applyConfig(value []byte) error {
+	var c VIPConfig
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return err
+	}
+	if len(c.VIPs) == 0 {
+		return errors.New("no VIP given")
+	}
+	m := r.Manager
+	vaddrs, err := parseAddrs(m.Netlink, c.VIPs)
+	if err != nil {
+		return err
+	}
+	iface := c.Interface
+	if iface == "" {
+		iface = m.InterfaceName()
+	}
+	if !m.CreateInterface {
+		if _, err := m.linkByName(iface); err != nil {
+			return err
+		}
+	}
+	if m.Label != "" && !strings.HasPrefix(m.Label, iface) {
+		return fmt.Errorf("the address label %q must start with the interface name %q", m.Label, iface)
+	}
+	if m.joinAddrs(vaddrs) == m.String() && iface == m.InterfaceName() {
+		return nil
+	}
+	r.logger().Infof("Switching to %v on %v from %v", m.joinAddrs(vaddrs), iface, r.ConfigKey)
+	return m.Replace(c.VIPs, iface)
+}
@@ -0,0 +1,256 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	client "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"google.golang.org/grpc/connectivity"
+)
+
+// Etcd is the Backend using etcd leases and the elections of the concurrency
+// package.
+type Etcd struct {
+	Client *client.Client
+	// LeaseTTL is the TTL of the session lease in seconds.
+	LeaseTTL int
+	// RequestTimeout bounds etcd requests other than waiting in Campaign,
+	// 5 seconds if zero.
+	RequestTimeout time.Duration
+
+	// member is the ID of the etcd member last logged as connected to
+	member uint64
+	follow sync.Once
+}
+
+func (b *Etcd) String() string {
+	return "etcd"
+}
+
+func (b *Etcd) requestTimeout() time.Duration {
+	if b.RequestTimeout > 0 {
+		return b.RequestTimeout
+	}
+	return 5 * time.Second
+}
+
+// NewSession grants a lease within the request timeout and starts a session
+// keeping it alive.
+func (b *Etcd) NewSession(ctx context.Context) (Session, error) {
+	gctx, cancel := context.WithTimeout(ctx, b.requestTimeout())
+	defer cancel()
+	lease, err := b.Client.Grant(gctx, int64(b.LeaseTTL))
+	if err != nil {
+		return nil, EtcdError(err)
+	}
+	if id := lease.ResponseHeader.MemberId; atomic.SwapUint64(&b.member, id) != id {
+		b.logMember(gctx, id)
+	}
+	s, err := concurrency.NewSession(b.Client, concurrency.WithLease(lease.ID), concurrency.WithTTL(b.LeaseTTL))
+	if err != nil {
+		// Revoked rather than left to expire, Run retries with a new
+		// lease each time
+		rctx, rcancel := context.WithTimeout(context.Background(), b.requestTimeout())
+		defer rcancel()
+		if _, rerr := b.Client.Revoke(rctx, lease.ID); rerr != nil {
+			componentLog(LogEtcd).Warnf("Failed to revoke lease %x: %v", lease.ID, rerr)
+		}
+		return nil, err
+	}
+	b.follow.Do(func() { go b.followConnection() })
+	etcdSessions.Inc()
+	componentLog(LogEtcd).Infof("Created etcd session with lease %x and a TTL of %ds", lease.ID, lease.TTL)
+	return &etcdSession{Session: s, backend: b}, nil
+}
+
+// followConnection keeps govip_etcd_connected up to date and logs when the
+// client connects to etcd or loses the connection, until the client is
+// closed.
+func (b *Etcd) followConnection() {
+	conn := b.Client.ActiveConnection()
+	ctx := b.Client.Ctx()
+	state := conn.GetState()
+	connected := state == connectivity.Ready
+	etcdConnected.Set(boolToFloat(connected))
+	for conn.WaitForStateChange(ctx, state) {
+		state = conn.GetState()
+		componentLog(LogEtcd).Debugf("etcd connection %v", state)
+		if ready := state == connectivity.Ready; ready != connected {
+			connected = ready
+			etcdConnected.Set(boolToFloat(connected))
+			if connected {
+				componentLog(LogEtcd).Info("Connected to etcd")
+			} else {
+				componentLog(LogEtcd).Warnf("Lost the connection to etcd, now %v", state)
+			}
+		}
+	}
+	etcdConnected.Set(0)
+}
+
+// logMember logs the name and client URLs of the etcd member with id, the
+// one the client is connected to.
+func (b *Etcd) logMember(ctx context.Context, id uint64) {
+	resp, err := b.Client.MemberList(ctx)
+	if err != nil {
+		componentLog(LogEtcd).Debugf("Failed to list etcd members: %v", err)
+		return
+	}
+	for _, m := range resp.Members {
+		if m.ID == id {
+			componentLog(LogEtcd).Infof("Connected to etcd member %v at %v", m.Name, strings.Join(m.ClientURLs, ","))
+			return
+		}
+	}
+}
+
+// EtcdError wraps the errors about the credentials or permissions in
+// ErrUnauthorized, also for an etcd client that failed to authenticate
+// while it was created.
+func EtcdError(err error) error {
+	switch err {
+	case rpctypes.ErrAuthFailed, rpctypes.ErrPermissionDenied, rpctypes.ErrUserEmpty, rpctypes.ErrAuthNotEnabled:
+		return fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	return err
+}
+
+type etcdSession struct {
+	*concurrency.Session
+	backend *Etcd
+}
+
+func (s *etcdSession) Election(prefix string) Election {
+	return &etcdElection{
+		Election: concurrency.NewElection(s.Session, prefix),
+		backend:  s.backend,
+		// The concurrency package keeps the candidates below prefix/
+		prefix: prefix + "/",
+	}
+}
+
+type etcdElection struct {
+	*concurrency.Election
+	backend *Etcd
+	prefix  string
+}
+
+func (e *etcdElection) Leader(ctx context.Context) (string, error) {
+	resp, err := e.Election.Leader(ctx)
+	if err == concurrency.ErrElectionNoLeader {
+		return "", ErrNoLeader
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+// Observe is unlike that of concurrency.Election in that it also sends an
+// empty string when the leader steps down without a successor.
+func (e *etcdElection) Observe(ctx context.Context) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		sent, last := false, ""
+		for values := range e.candidates(ctx) {
+			leader := ""
+			if len(values) > 0 {
+				leader = values[0]
+			}
+			if sent && leader == last {
+				continue
+			}
+			select {
+			case ch <- leader:
+			case <-ctx.Done():
+				return
+			}
+			sent, last = true, leader
+		}
+	}()
+	return ch
+}
+
+func (e *etcdElection) Waiting(ctx context.Context) <-chan []string {
+	ch := make(chan []string)
+	go func() {
+		defer close(ch)
+		var last []string
+		sent := false
+		for values := range e.candidates(ctx) {
+			var waiting []string
+			if len(values) > 1 {
+				waiting = values[1:]
+			}
+			if sent && strings.Join(waiting, "\n") == strings.Join(last, "\n") {
+				continue
+			}
+			select {
+			case ch <- waiting:
+			case <-ctx.Done():
+				return
+			}
+			sent, last = true, waiting
+		}
+	}()
+	return ch
+}
+
+// candidates sends the values of all candidates, the leader first and the
+// others in the order they wait in line, now and after every change until
+// ctx is cancelled.
+func (e *etcdElection) candidates(ctx context.Context) <-chan []string {
+	ch := make(chan []string)
+	go func() {
+		defer close(ch)
+		for attempt := 0; ctx.Err() == nil; {
+			gctx, cancel := context.WithTimeout(ctx, e.backend.requestTimeout())
+			resp, err := e.backend.Client.Get(gctx, e.prefix, client.WithPrefix(),
+				client.WithSort(client.SortByCreateRevision, client.SortAscend))
+			cancel()
+			if err != nil {
+				if !sleep(ctx, backoff(attempt)) {
+					return
+				}
+				attempt++
+				continue
+			}
+			attempt = 0
+			values := make([]string, len(resp.Kvs))
+			for i, kv := range resp.Kvs {
+				values[i] = string(kv.Value)
+			}
+			select {
+			case ch <- values:
+			case <-ctx.Done():
+				return
+			}
+			// Any change, or a failed watch, lists them again
+			wctx, cancel := context.WithCancel(ctx)
+			<-e.backend.Client.Watch(wctx, e.prefix, client.WithPrefix(), client.WithRev(resp.Header.Revision+1))
+			cancel()
+		}
+	}()
+	return ch
+}
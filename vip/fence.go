@@ -0,0 +1,108 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// QuorumChecker is implemented by sessions that can check the backend is
+// still able to arbitrate the leadership, which a session that hasn't
+// expired doesn't tell: without quorum an etcd lease neither expires nor
+// renews.
+type QuorumChecker interface {
+	// CheckQuorum returns an error unless the backend confirmed the
+	// session is alive.
+	CheckQuorum(ctx context.Context) error
+}
+
+// CheckQuorum asks for the TTL of the session lease, which needs the etcd
+// leader and so a quorum.
+func (s *etcdSession) CheckQuorum(ctx context.Context) error {
+	resp, err := s.Client().TimeToLive(ctx, s.Lease())
+	if err != nil {
+		return err
+	}
+	if resp.TTL <= 0 {
+		return errors.New("lease expired")
+	}
+	return nil
+}
+
+// watchQuorum returns a channel that is closed once s has failed to confirm
+// the session for FenceTimeout, until ctx is cancelled. It is never closed
+// if FenceTimeout is zero or s isn't a QuorumChecker.
+func (r *Runner) watchQuorum(ctx context.Context, s Session) <-chan struct{} {
+	lost := make(chan struct{})
+	q, ok := s.(QuorumChecker)
+	if !ok || r.FenceTimeout <= 0 {
+		return lost
+	}
+	interval := r.FenceTimeout / 4
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		confirmed := time.Now()
+		for {
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+			cctx, cancel := context.WithTimeout(ctx, interval)
+			err := q.CheckQuorum(cctx)
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+			if err == nil {
+				confirmed = time.Now()
+				continue
+			}
+			r.logger().Warnf("Failed to confirm the %v session: %v", r.Backend, err)
+			if time.Since(confirmed) >= r.FenceTimeout {
+				r.logger().Errorf("%v hasn't confirmed the session for %v, it may have lost quorum. "+
+					"Releasing IP addresses rather than risking a split brain", r.Backend, r.FenceTimeout)
+				r.mu.Lock()
+				r.quorumLosses++
+				r.mu.Unlock()
+				close(lost)
+				return
+			}
+		}
+	}()
+	return lost
+}
+
+// waitQuorum blocks until the backend confirms the session again. It returns
+// false if ctx is cancelled first.
+func (r *Runner) waitQuorum(ctx context.Context, s Session) bool {
+	q := s.(QuorumChecker)
+	interval := r.FenceTimeout / 4
+	for {
+		cctx, cancel := context.WithTimeout(ctx, interval)
+		err := q.CheckQuorum(cctx)
+		cancel()
+		if err == nil {
+			r.logger().Infof("%v confirmed the session again", r.Backend)
+			return true
+		}
+		if !sleep(ctx, interval) {
+			return false
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/j-keck/arping"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ARP member selection for ARPMembers.
+const (
+	// ARPMembersNone sends on the bond or bridge itself.
+	ARPMembersNone = "none"
+	// ARPMembersActive sends out the active bond slaves or the bridge ports
+	// that are up.
+	ARPMembersActive = "active"
+	// ARPMembersAll sends out every member.
+	ARPMembersAll = "all"
+)
+
+// ARP packet types for ARPType.
+const (
+	// ARPTypeRequest announces with ARP requests, like arping -U.
+	ARPTypeRequest = "request"
+	// ARPTypeReply announces with ARP replies, like arping -A.
+	ARPTypeReply = "reply"
+	// ARPTypeBoth sends one of each.
+	ARPTypeBoth = "both"
+)
+
+// ARP operation codes.
+const (
+	arpOpRequest = 1
+	arpOpReply   = 2
+)
+
+// arpOps returns the ARP operations to announce with, ARPTypeRequest if
+// ARPType is empty.
+func (m *Manager) arpOps() []byte {
+	switch m.ARPType {
+	case ARPTypeReply:
+		return []byte{arpOpReply}
+	case ARPTypeBoth:
+		return []byte{arpOpRequest, arpOpReply}
+	default:
+		return []byte{arpOpRequest}
+	}
+}
+
+// arpMembers returns the members of the bond or bridge iface that ARPMembers
+// selects, and the address of iface to announce, or nil if the gratuitous
+// ARPs should go out iface itself.
+func (m *Manager) arpMembers(iface string) ([]string, net.HardwareAddr) {
+	if m.ARPMembers == "" || m.ARPMembers == ARPMembersNone {
+		return nil, nil
+	}
+	var link netlink.Link
+	if err := m.inNamespace(func() (err error) {
+		link, err = netlink.LinkByName(iface)
+		return err
+	}); err != nil {
+		return nil, nil
+	}
+	switch link.(type) {
+	case *netlink.Bond, *netlink.Bridge:
+	default:
+		return nil, nil
+	}
+	var links []netlink.Link
+	if err := m.inNamespace(func() (err error) {
+		links, err = netlink.LinkList()
+		return err
+	}); err != nil {
+		m.arpLogger().Debugf("Failed to list the members of %v, sending gratuitous ARPs on it: %v", iface, err)
+		return nil, nil
+	}
+	var members []string
+	for _, l := range links {
+		attrs := l.Attrs()
+		if attrs.MasterIndex != link.Attrs().Index {
+			continue
+		}
+		if m.ARPMembers == ARPMembersActive && !activeMember(l) {
+			continue
+		}
+		members = append(members, attrs.Name)
+	}
+	if len(members) == 0 {
+		m.arpLogger().Debugf("No %v members of %v found, sending gratuitous ARPs on it", m.ARPMembers, iface)
+		return nil, nil
+	}
+	return members, link.Attrs().HardwareAddr
+}
+
+// activeMember reports whether l is an active bond slave, or a bridge port
+// that is up.
+func activeMember(l netlink.Link) bool {
+	if s, ok := l.Attrs().Slave.(*netlink.BondSlave); ok {
+		return s.State == netlink.BondStateActive
+	}
+	return l.Attrs().OperState == netlink.OperUp
+}
+
+// announceTargets sends an ARP request for each of ARPTargets from each IPv4
+// address of b. A peer asked for its own address learns the sender, so its
+// entry for the VIP is updated even if it ignores gratuitous ARPs.
+func (m *Manager) announceTargets(b arpBurst) {
+	if len(m.ARPTargets) == 0 {
+		return
+	}
+	if m.DryRun {
+		m.arpLogger().Infof("Dry run: would send ARP requests to %d peers", len(m.ARPTargets))
+		return
+	}
+	for _, vaddr := range b.addrs {
+		if vaddr.IP.To4() == nil {
+			continue
+		}
+		for _, iface := range b.ifaces {
+			for _, target := range m.ARPTargets {
+				err := m.inNamespace(func() error { return arpRequest(vaddr.IP, target, nil, iface) })
+				if err != nil {
+					m.arpLogger().Warnf("Failed to send ARP request for %v from %v on %v: %v", target, vaddr.IP, iface, err)
+					arpFailures.WithLabelValues(m.Group).Inc()
+					continue
+				}
+				arpSent.WithLabelValues(m.Group).Inc()
+			}
+		}
+	}
+}
+
+// arpingLock serializes the pings of arping, whose timeout is shared by the
+// whole process, so a gateway probe and the conflict checks of several groups
+// don't change it under each other. It is a channel so waiting for it can be
+// given up with a context.
+var arpingLock = make(chan struct{}, 1)
+
+// pingARP asks who has ip on iface with arping and returns the MAC that
+// answered. It waits for an answer for timeout once no other ping is running,
+// but not past the deadline of ctx.
+func pingARP(ctx context.Context, ip net.IP, iface string, timeout time.Duration) (net.HardwareAddr, error) {
+	select {
+	case arpingLock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-arpingLock }()
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	if timeout <= 0 {
+		return nil, arping.ErrTimeout
+	}
+	arping.SetTimeout(timeout)
+	mac, _, err := arping.PingOverIfaceByName(ip, iface)
+	return mac, err
+}
+
+// gratuitousARP broadcasts a gratuitous ARP request or reply, by op, for ip
+// out ifname, with src and mac as the sender, ip and the address of ifname if
+// nil. Unlike arping it doesn't have to use the address of ifname, so members
+// of a bond or bridge can announce the address of their master.
+func gratuitousARP(op byte, ip, src net.IP, mac net.HardwareAddr, ifname string) error {
+	if src == nil {
+		src = ip
+	}
+	return arpPacket(op, src, ip, mac, ifname)
+}
+
+// arpRequest broadcasts an ARP request for target out ifname, with sender
+// and mac, the address of ifname if nil, as the sender.
+func arpRequest(sender, target net.IP, mac net.HardwareAddr, ifname string) error {
+	return arpPacket(arpOpRequest, sender, target, mac, ifname)
+}
+
+// arpPacket broadcasts an ARP packet with operation op for target out
+// ifname, like arpRequest. A reply has the sender's MAC as the target's, like
+// the ones of arping -A.
+func arpPacket(op byte, sender, target net.IP, mac net.HardwareAddr, ifname string) error {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return err
+	}
+	if mac == nil {
+		mac = iface.HardwareAddr
+	}
+	target4, sender4 := target.To4(), sender.To4()
+	if target4 == nil || sender4 == nil || len(mac) != 6 {
+		return fmt.Errorf("can't send an ARP request for %v from %v %v", target, sender, mac)
+	}
+	proto := htons(unix.ETH_P_ARP)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(proto))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	frame := make([]byte, 0, 42)
+	frame = append(frame, broadcast...)
+	frame = append(frame, mac...)
+	frame = append(frame, unix.ETH_P_ARP>>8, unix.ETH_P_ARP&0xff)
+	// Ethernet, IPv4, address lengths and the operation
+	frame = append(frame, 0, 1, 8, 0, 6, 4, 0, op)
+	frame = append(frame, mac...)
+	frame = append(frame, sender4...)
+	if op == arpOpReply {
+		frame = append(frame, mac...)
+	} else {
+		frame = append(frame, make([]byte, 6)...)
+	}
+	frame = append(frame, target4...)
+
+	addr := &unix.SockaddrLinklayer{
+		Protocol: proto,
+		Ifindex:  iface.Index,
+		Halen:    6,
+	}
+	copy(addr.Addr[:], broadcast)
+	return unix.Sendto(fd, frame, 0, addr)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,256 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+var (
+	probeResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "govip_health_checks_total",
+		Help: "Number of health check probes by probe and result.",
+	}, []string{"probe", "result"})
+	probeUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "govip_health_probe_up",
+		Help: "Whether the last run of the probe passed.",
+	}, []string{"probe"})
+)
+
+func init() {
+	prometheus.MustRegister(probeResults, probeUp)
+}
+
+// Probe checks whether this node is fit to hold the VIPs. String names the
+// probe in logs and metrics.
+type Probe interface {
+	Probe(ctx context.Context) error
+	String() string
+}
+
+// CommandProbe runs a shell command, it passes when the command exits with
+// status 0.
+type CommandProbe struct {
+	Command string
+}
+
+func (p CommandProbe) Probe(ctx context.Context) error {
+	out, err := exec.CommandContext(ctx, "/bin/sh", "-c", p.Command).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
+
+func (p CommandProbe) String() string { return "cmd" }
+
+// HTTPProbe passes when a GET of URL returns a 2xx status.
+type HTTPProbe struct {
+	URL string
+}
+
+func (p HTTPProbe) Probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%v returned %v", p.URL, resp.Status)
+	}
+	return nil
+}
+
+func (p HTTPProbe) String() string { return "http" }
+
+// TCPProbe passes when a TCP connection to Address can be established.
+type TCPProbe struct {
+	Address string
+}
+
+func (p TCPProbe) Probe(ctx context.Context) error {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", p.Address)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+func (p TCPProbe) String() string { return "tcp" }
+
+// ARPProbe passes when IP, e.g. the gateway, answers an ARP request on
+// Interface, or on the interface the route to IP goes through if Interface
+// is empty. It catches a node cut off from its subnet while it can still
+// reach the backend. With Namespace set the request is sent in that network
+// namespace, e.g. a Netns.
+type ARPProbe struct {
+	IP        net.IP
+	Interface string
+	Namespace Doer
+}
+
+func (p ARPProbe) Probe(ctx context.Context) error {
+	if p.Namespace != nil {
+		return p.Namespace.Do(func() error { return p.probe(ctx) })
+	}
+	return p.probe(ctx)
+}
+
+func (p ARPProbe) probe(ctx context.Context) error {
+	iface := p.Interface
+	if iface == "" {
+		routes, err := netlink.RouteGet(p.IP)
+		if err != nil {
+			return err
+		}
+		if len(routes) == 0 {
+			return fmt.Errorf("no route to %v", p.IP)
+		}
+		link, err := netlink.LinkByIndex(routes[0].LinkIndex)
+		if err != nil {
+			return err
+		}
+		iface = link.Attrs().Name
+	}
+	timeout := arpProbeTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if _, err := pingARP(ctx, p.IP, iface, timeout); err != nil {
+		return fmt.Errorf("%v on %v: %v", p.IP, iface, err)
+	}
+	return nil
+}
+
+func (p ARPProbe) String() string { return "arp" }
+
+// arpProbeTimeout is how long an ARPProbe without a deadline waits for the
+// answer, the default of arping.
+const arpProbeTimeout = 500 * time.Millisecond
+
+// HealthCheck runs its probes on an interval. The node becomes healthy once
+// all probes pass and unhealthy after Threshold consecutive failed rounds, so
+// a single blip doesn't demote the leader.
+type HealthCheck struct {
+	Probes    []Probe
+	Interval  time.Duration
+	Threshold int
+
+	mu       sync.Mutex
+	healthy  bool
+	failures int
+	changed  chan struct{}
+}
+
+// Update changes the probes and settings while running.
+func (h *HealthCheck) Update(probes []Probe, interval time.Duration, threshold int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Probes = probes
+	h.Interval = interval
+	h.Threshold = threshold
+}
+
+func (h *HealthCheck) settings() ([]Probe, time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.Probes, h.Interval
+}
+
+// Run probes until ctx is cancelled.
+func (h *HealthCheck) Run(ctx context.Context) {
+	for {
+		probes, interval := h.settings()
+		h.check(ctx, probes, interval)
+		if !sleep(ctx, interval) {
+			return
+		}
+	}
+}
+
+func (h *HealthCheck) check(ctx context.Context, probes []Probe, interval time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, interval)
+	defer cancel()
+	var err error
+	for _, p := range probes {
+		perr := p.Probe(ctx)
+		if perr != nil {
+			probeResults.WithLabelValues(p.String(), "fail").Inc()
+			probeUp.WithLabelValues(p.String()).Set(0)
+			if err == nil {
+				err = fmt.Errorf("%v: %v", p, perr)
+			}
+			continue
+		}
+		probeResults.WithLabelValues(p.String(), "pass").Inc()
+		probeUp.WithLabelValues(p.String()).Set(1)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	healthy := h.healthy
+	if err == nil {
+		h.failures = 0
+		healthy = true
+	} else {
+		h.failures++
+		log.Warnf("Health check failed (%d/%d): %v", h.failures, h.Threshold, err)
+		if h.failures >= h.Threshold {
+			healthy = false
+		}
+	}
+	if healthy != h.healthy {
+		if healthy {
+			log.Info("Health check passed, taking part in the election")
+		} else {
+			log.Warn("Health check failed, stepping aside")
+		}
+		h.healthy = healthy
+		h.notify()
+	}
+}
+
+func (h *HealthCheck) notify() {
+	if h.changed != nil {
+		close(h.changed)
+	}
+	h.changed = make(chan struct{})
+}
+
+// Healthy reports whether the node is healthy, and returns a channel that is
+// closed when that changes.
+func (h *HealthCheck) Healthy() (bool, <-chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.changed == nil {
+		h.changed = make(chan struct{})
+	}
+	return h.healthy, h.changed
+}
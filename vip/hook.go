@@ -0,0 +1,83 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var hookFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "govip_hook_failures_total",
+	Help: "Number of hook commands that failed.",
+}, []string{"group", "hook"})
+
+func init() {
+	prometheus.MustRegister(hookFailures)
+}
+
+// hookWaitDelay is how long a killed hook's output is still read for, in
+// case a process it started keeps it open.
+const hookWaitDelay = time.Second
+
+// runHook runs the command at path with the VIPs and interface of m in
+// GOVIP_VIP and GOVIP_VIF, logging its output. It is killed if it hasn't
+// finished within timeout, unless that is zero. Empty paths are ignored.
+func runHook(name, path string, timeout time.Duration, m *Manager) {
+	if path == "" {
+		return
+	}
+	l := m.logger().WithField("hook", name)
+	if m.DryRun {
+		l.Infof("Dry run: would run %v", path)
+		return
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Env = append(os.Environ(), "GOVIP_VIP="+m.String(), "GOVIP_VIF="+m.InterfaceName())
+	cmd.WaitDelay = hookWaitDelay
+	out, err := cmd.CombinedOutput()
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		l.Info(sc.Text())
+	}
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// The hook itself succeeded
+		l.Warnf("Hook %v left a process running that keeps its output open, stopped reading it", path)
+		err = nil
+	} else if err != nil && ctx.Err() == context.DeadlineExceeded {
+		l.Errorf("Hook %v didn't finish within %v, killed it", path, timeout)
+		hookFailures.WithLabelValues(m.Group, name).Inc()
+		return
+	}
+	if err != nil {
+		l.Errorf("Hook %v failed: %v", path, err)
+		hookFailures.WithLabelValues(m.Group, name).Inc()
+		return
+	}
+	l.Debugf("Hook %v finished", path)
+}
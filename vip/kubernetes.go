@@ -0,0 +1,245 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Kubernetes is the Backend using a coordination.k8s.io Lease through the
+// leaderelection package of client-go. The Lease is named after the election
+// prefix, e.g. govip for /govip/. Like with Consul there is no line to wait
+// in.
+type Kubernetes struct {
+	Client    kubernetes.Interface
+	Namespace string
+	// LeaseDuration is how long the Lease is valid without being renewed.
+	LeaseDuration time.Duration
+}
+
+func (b *Kubernetes) String() string {
+	return "Kubernetes"
+}
+
+// The leader renews the Lease every retryPeriod and gives it up if that
+// fails for renewDeadline, well before others may take it over.
+func (b *Kubernetes) renewDeadline() time.Duration {
+	return b.LeaseDuration * 2 / 3
+}
+
+func (b *Kubernetes) retryPeriod() time.Duration {
+	return b.LeaseDuration / 6
+}
+
+// NewSession returns a session that lasts until it is closed or, like an
+// expired etcd session, until its leader elector stopped leading because it
+// couldn't renew the Lease. Only the leader keeps anything alive in
+// Kubernetes.
+func (b *Kubernetes) NewSession(ctx context.Context) (Session, error) {
+	return &kubeSession{backend: b, done: make(chan struct{})}, nil
+}
+
+type kubeSession struct {
+	backend *Kubernetes
+	done    chan struct{}
+	once    sync.Once
+
+	mu     sync.Mutex
+	leases []string
+}
+
+func (s *kubeSession) Election(prefix string) Election {
+	name := strings.ReplaceAll(strings.Trim(prefix, "/"), "/", "-")
+	s.mu.Lock()
+	s.leases = append(s.leases, name)
+	s.mu.Unlock()
+	return &kubeElection{backend: s.backend, session: s, name: name}
+}
+
+// CheckQuorum gets the Leases of the session's elections. A get without a
+// resource version is a quorum read of the etcd behind the API server, so
+// like for the etcd backend it fails while nobody can arbitrate.
+func (s *kubeSession) CheckQuorum(ctx context.Context) error {
+	s.mu.Lock()
+	leases := append([]string(nil), s.leases...)
+	s.mu.Unlock()
+	for _, name := range leases {
+		_, err := s.backend.Client.CoordinationV1().Leases(s.backend.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *kubeSession) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *kubeSession) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+type kubeElection struct {
+	backend *Kubernetes
+	session *kubeSession
+	name    string
+
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+// Campaign starts a leader elector that keeps running, and renewing the
+// Lease, until Resign. If it stops on its own after winning, it failed to
+// renew the Lease and others may take it over, so the session is closed to
+// release the VIPs like when an etcd session expires.
+func (e *kubeElection) Campaign(ctx context.Context, value string) error {
+	won := make(chan struct{})
+	lctx, cancel := context.WithCancel(context.Background())
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Name: e.name, Namespace: e.backend.Namespace},
+			Client:     e.backend.Client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: value},
+		},
+		LeaseDuration:   e.backend.LeaseDuration,
+		RenewDeadline:   e.backend.renewDeadline(),
+		RetryPeriod:     e.backend.retryPeriod(),
+		ReleaseOnCancel: true,
+		Name:            e.name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) { close(won) },
+			OnStoppedLeading: func() {
+				if lctx.Err() != nil {
+					return
+				}
+				log.Warnf("Failed to renew Lease %v, leadership lost", e.name)
+				e.session.Close()
+			},
+		},
+	})
+	if err != nil {
+		cancel()
+		return err
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		le.Run(lctx)
+	}()
+	select {
+	case <-won:
+		e.mu.Lock()
+		e.cancel, e.stopped = cancel, stopped
+		e.mu.Unlock()
+		return nil
+	case <-ctx.Done():
+		cancel()
+		<-stopped
+		return ctx.Err()
+	}
+}
+
+// Resign stops the leader elector, which releases the Lease.
+func (e *kubeElection) Resign(ctx context.Context) error {
+	e.mu.Lock()
+	cancel, stopped := e.cancel, e.stopped
+	e.cancel, e.stopped = nil, nil
+	e.mu.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *kubeElection) Leader(ctx context.Context) (string, error) {
+	lease, err := e.backend.Client.CoordinationV1().Leases(e.backend.Namespace).Get(ctx, e.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", ErrNoLeader
+	}
+	if err != nil {
+		return "", err
+	}
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return "", ErrNoLeader
+	}
+	expiry := spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)
+	if time.Now().After(expiry) {
+		return "", ErrNoLeader
+	}
+	return *spec.HolderIdentity, nil
+}
+
+// Observe polls the Lease every retry period, the same cadence the leader
+// elector uses. Once it couldn't get the Lease for the renew deadline it
+// reports no leader, as by then the leader has stepped down if it couldn't
+// reach the API server either.
+func (e *kubeElection) Observe(ctx context.Context) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		sent, last := false, ""
+		var failing time.Time
+		for {
+			leader, err := e.Leader(ctx)
+			if err == ErrNoLeader {
+				leader, err = "", nil
+			}
+			if err != nil {
+				log.Debugf("Failed to get Lease %v: %v", e.name, err)
+				if failing.IsZero() {
+					failing = time.Now()
+				}
+				if time.Since(failing) >= e.backend.renewDeadline() && (!sent || last != "") {
+					log.Warnf("Failed to get Lease %v for %v: %v", e.name, e.backend.renewDeadline(), err)
+					leader, err = "", nil
+				}
+			} else {
+				failing = time.Time{}
+			}
+			if err == nil && (!sent || leader != last) {
+				select {
+				case ch <- leader:
+				case <-ctx.Done():
+					return
+				}
+				sent, last = true, leader
+			}
+			if !sleep(ctx, e.backend.retryPeriod()) {
+				return
+			}
+		}
+	}()
+	return ch
+}
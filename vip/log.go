@@ -0,0 +1,137 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The components whose logs can be given their own level with SetLogLevels.
+const (
+	// LogElection is campaigning, leading and handing over.
+	LogElection = "election"
+	// LogReconcile is setting, checking and releasing the VIPs.
+	LogReconcile = "reconcile"
+	// LogARP is gratuitous ARPs, neighbor advertisements, conflict checks
+	// and the ARP sysctls.
+	LogARP = "arp"
+	// LogEtcd is the connection and sessions of the etcd backend.
+	LogEtcd = "etcd"
+)
+
+// LogComponents lists the components SetLogLevels accepts.
+var LogComponents = []string{LogElection, LogReconcile, LogARP, LogEtcd}
+
+var (
+	logMu            sync.Mutex
+	componentLoggers = map[string]*log.Logger{}
+)
+
+// SetLogLevels gives the logs of each component in levels their own level.
+// The other components log through the standard logger again, at its level.
+// The output and formatter are always those of the standard logger.
+func SetLogLevels(levels map[string]log.Level) error {
+	loggers := map[string]*log.Logger{}
+	for c, level := range levels {
+		if !knownComponent(c) {
+			return fmt.Errorf("unknown log component %q, expected one of %v", c, strings.Join(LogComponents, ", "))
+		}
+		l := log.New()
+		l.Out = stdWriter{}
+		l.Formatter = stdFormatter{}
+		l.Hooks = log.StandardLogger().Hooks
+		l.SetLevel(level)
+		loggers[c] = l
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	componentLoggers = loggers
+	return nil
+}
+
+// ParseLogLevels parses a comma separated list of component=level pairs and
+// at most one plain level, which is returned as global, e.g.
+// "info,arp=debug". global is empty if there is no plain level.
+func ParseLogLevels(s string) (global string, levels map[string]log.Level, err error) {
+	levels = map[string]log.Level{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		c, value, ok := strings.Cut(item, "=")
+		if !ok {
+			if global != "" {
+				return "", nil, fmt.Errorf("%q: more than one level without a component", s)
+			}
+			if _, err := log.ParseLevel(item); err != nil {
+				return "", nil, err
+			}
+			global = item
+			continue
+		}
+		if !knownComponent(c) {
+			return "", nil, fmt.Errorf("unknown log component %q, expected one of %v", c, strings.Join(LogComponents, ", "))
+		}
+		if _, dup := levels[c]; dup {
+			return "", nil, fmt.Errorf("%q: component %v given twice", s, c)
+		}
+		level, err := log.ParseLevel(value)
+		if err != nil {
+			return "", nil, fmt.Errorf("%v: %v", c, err)
+		}
+		levels[c] = level
+	}
+	return global, levels, nil
+}
+
+func knownComponent(c string) bool {
+	for _, known := range LogComponents {
+		if c == known {
+			return true
+		}
+	}
+	return false
+}
+
+// componentLog returns the logger of component, the standard logger unless
+// SetLogLevels gave it a level.
+func componentLog(component string) *log.Logger {
+	logMu.Lock()
+	defer logMu.Unlock()
+	if l := componentLoggers[component]; l != nil {
+		return l
+	}
+	return log.StandardLogger()
+}
+
+// stdWriter and stdFormatter pass the entries of the component loggers on to
+// the output and formatter the standard logger has at the time, so they
+// follow changes to it.
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	return log.StandardLogger().Out.Write(p)
+}
+
+type stdFormatter struct{}
+
+func (stdFormatter) Format(e *log.Entry) ([]byte, error) {
+	return log.StandardLogger().Formatter.Format(e)
+}
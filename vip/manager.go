@@ -0,0 +1,873 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vip claims and releases virtual IP addresses on behalf of the
+// elected leader of a group of govip instances.
+package vip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/j-keck/arping"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const infiniteLifetime = 0xffffffff
+
+// The errors of Manager wrap one of these, so callers can tell the failures
+// apart with errors.Is, and the underlying error where there is one.
+var (
+	// ErrInterfaceNotFound is wrapped when the interface the VIPs are set
+	// on, or the parent of a virtual one, doesn't exist.
+	ErrInterfaceNotFound = errors.New("interface not found")
+	// ErrInvalidVIP is wrapped when a VIP can't be parsed.
+	ErrInvalidVIP = errors.New("invalid VIP")
+	// ErrAddrAddFailed and ErrAddrDelFailed are the Kind of an AddrError.
+	// ErrAddrDelFailed is also wrapped when a VIP is still set after
+	// removing it.
+	ErrAddrAddFailed = errors.New("failed to add IP address")
+	ErrAddrDelFailed = errors.New("failed to remove IP address")
+	// ErrAddrConflict is wrapped when ConflictCheck finds a VIP in use by
+	// another host.
+	ErrAddrConflict = errors.New("IP address conflict")
+)
+
+// AddrError is returned when adding or removing a VIP fails. It wraps both
+// Kind and Err.
+type AddrError struct {
+	// Kind is ErrAddrAddFailed or ErrAddrDelFailed.
+	Kind      error
+	Addr      *netlink.Addr
+	Interface string
+	// Err is the error of the last attempt, e.g. a unix.Errno from netlink.
+	Err error
+}
+
+func (e *AddrError) Error() string {
+	return fmt.Sprintf("%v %v on %v: %v", e.Kind, e.Addr.IPNet, e.Interface, e.Err)
+}
+
+func (e *AddrError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// Manager sets a group of VIPs on an interface and removes them again.
+type Manager struct {
+	// Addrs are the VIPs, all of them are set and released together.
+	Addrs []*netlink.Addr
+	// Interface is the name of the link the VIPs are set on.
+	Interface string
+	// ARPCount is the number of gratuitous ARPs (or unsolicited neighbor
+	// advertisements for IPv6) to send for each VIP after setting it.
+	ARPCount int
+	// ARPInterval is the time between gratuitous ARPs.
+	ARPInterval time.Duration
+	// ARPType selects the packets to announce IPv4 VIPs with,
+	// ARPTypeRequest if empty.
+	ARPType string
+	// ARPDelay, if set, is the time between setting the VIPs and sending
+	// the gratuitous ARPs, which leaves services time to bind to the VIPs,
+	// e.g. started by the acquire hook, before traffic is sent their way.
+	ARPDelay time.Duration
+	// ARPInterfaces, if set, are the links the gratuitous ARPs are sent
+	// from instead of Interface, e.g. the physical member of a VLAN, or all
+	// of them on a host announcing the VIPs on several networks.
+	ARPInterfaces []string
+	// ARPTargets are peers sent an ARP request from each IPv4 VIP right
+	// after setting it, so they update their entry for the VIP first.
+	ARPTargets []net.IP
+	// ARPSource, if set, is the sender address of the gratuitous ARPs for
+	// IPv4 VIPs instead of the VIP itself.
+	ARPSource net.IP
+	// AddRoute adds a link-scope route to the network of each VIP that isn't
+	// on-link on Interface, i.e. not in the subnet of any of its other
+	// addresses, when setting the VIPs and removes it when releasing them.
+	// The route has the VIP as source. A network the kernel already has a
+	// prefix route to is left alone.
+	AddRoute bool
+	// BackupInterface, if set, is where the VIPs move while Interface has
+	// no carrier, during Runner.Run.
+	BackupInterface string
+	// ARPMembers selects the members of a bond or bridge the gratuitous
+	// ARPs go out, ARPMembersNone if empty. They announce the address of
+	// the bond or bridge. It falls back to sending on the bond or bridge
+	// when no members are found.
+	ARPMembers string
+	// CreateInterface creates Interface with type InterfaceType when it
+	// doesn't exist. It is left in place when the VIPs are released.
+	CreateInterface bool
+	InterfaceType   string
+	// VirtualMAC, if set, makes Interface a macvlan interface with this MAC
+	// on top of Parent, created when missing. It is only up while the VIPs
+	// are set, so the MAC moves with them and peers needn't update their
+	// ARP entries on failover.
+	VirtualMAC net.HardwareAddr
+	Parent     string
+	// ConflictCheck sends an ARP request for each IPv4 VIP before setting it
+	// and refuses to set it if another host answers within ConflictTimeout.
+	ConflictCheck   bool
+	ConflictTimeout time.Duration
+	// ARPIgnore and ARPAnnounce, unless negative, are written to the
+	// arp_ignore and arp_announce sysctls of the interface the gratuitous
+	// ARPs go out before setting the VIPs. NoARP sets the NOARP flag on
+	// Interface, so it never answers ARP requests itself.
+	ARPIgnore   int
+	ARPAnnounce int
+	NoARP       bool
+	// Label, Scope and PreferredLifetime are set on the addresses, zero
+	// values keep the kernel defaults of no label, global scope and an
+	// infinite lifetime.
+	Label             string
+	Scope             int
+	PreferredLifetime time.Duration
+	// Group names the group of VIPs in logs and metrics when several run in
+	// one process.
+	Group string
+	// DryRun only logs the gratuitous ARPs and hooks. Netlink should be
+	// wrapped with NewDryRun as well.
+	DryRun bool
+	// Netlink manages the addresses, the kernel unless replaced.
+	Netlink NetLinker
+	// NetlinkRetries is how many times a failed address change is retried,
+	// NetlinkRetryInterval apart and doubling after each attempt.
+	NetlinkRetries       int
+	NetlinkRetryInterval time.Duration
+
+	// mu serializes the operations, Addrs, Interface and the ARP settings
+	// can be changed safely with Replace and SetARP while in use. The
+	// gratuitous ARPs go out after unlocking it, from an arpBurst.
+	mu    sync.Mutex
+	names atomic.Value
+	// present is 1 if all VIPs were set at the last check
+	present int32
+	// bursts counts the calls of announce that sent ARPs, arpFailing is 1
+	// if none of the last one went out
+	bursts     int64
+	arpFailing int32
+	// releases counts the calls of releaseOn, a burst started before one
+	// stops sending
+	releases int64
+}
+
+type names struct {
+	vip, vif string
+	log      *log.Entry
+}
+
+// NewManager returns a Manager for the VIPs in CIDR notation on iface.
+func NewManager(vips []string, iface string) (*Manager, error) {
+	return NewManagerWith(Netlink{}, vips, iface)
+}
+
+// NewManagerWith is like NewManager but manages the addresses through nl.
+func NewManagerWith(nl NetLinker, vips []string, iface string) (*Manager, error) {
+	m := &Manager{
+		Interface:       iface,
+		ARPCount:        5,
+		ARPInterval:     1 * time.Second,
+		InterfaceType:   "dummy",
+		ConflictTimeout: 1 * time.Second,
+		ARPIgnore:       -1,
+		ARPAnnounce:     -1,
+		Netlink:         nl,
+
+		NetlinkRetries:       3,
+		NetlinkRetryInterval: 200 * time.Millisecond,
+	}
+	var err error
+	if m.Addrs, err = parseAddrs(nl, vips); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseAddrs(nl NetLinker, vips []string) ([]*netlink.Addr, error) {
+	var vaddrs []*netlink.Addr
+	for _, v := range vips {
+		vaddr, err := nl.ParseAddr(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %v", ErrInvalidVIP, v, err)
+		}
+		if vaddr.IP.To4() == nil {
+			// Skip duplicate address detection so the VIP is usable and
+			// can be advertised right away
+			vaddr.Flags |= unix.IFA_F_NODAD
+		}
+		vaddrs = append(vaddrs, vaddr)
+	}
+	return vaddrs, nil
+}
+
+// Has reports for each VIP whether it is already set on the interface.
+func (m *Manager) Has() ([]bool, netlink.Link, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.has()
+}
+
+func (m *Manager) has() ([]bool, netlink.Link, error) {
+	set, vlink, err := m.hasOn(m.Interface, m.Addrs)
+	if err == nil {
+		m.setPresent(!anyUnset(set))
+	}
+	return set, vlink, err
+}
+
+func (m *Manager) setPresent(present bool) {
+	var v int32
+	if present {
+		v = 1
+	}
+	atomic.StoreInt32(&m.present, v)
+	vipPresent.WithLabelValues(m.Group).Set(boolToFloat(present))
+}
+
+// Present reports whether all VIPs were set when they were last checked,
+// added or released. Unlike Has it doesn't ask netlink, so it doesn't wait
+// for a Manager busy sending gratuitous ARPs.
+func (m *Manager) Present() bool {
+	return atomic.LoadInt32(&m.present) == 1
+}
+
+// hasOn reports for each of addrs whether it is set on iface.
+func (m *Manager) hasOn(iface string, vaddrs []*netlink.Addr) ([]bool, netlink.Link, error) {
+	vlink, err := m.linkByName(iface)
+	if err != nil {
+		if m.CreateInterface || m.VirtualMAC != nil {
+			// It is created when the VIPs are set
+			return make([]bool, len(vaddrs)), nil, nil
+		}
+		return nil, nil, err
+	}
+	addrs, err := m.Netlink.AddrList(vlink, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	set := make([]bool, len(vaddrs))
+	for i, vaddr := range vaddrs {
+		for _, addr := range addrs {
+			if vaddr.Equal(addr) {
+				set[i] = true
+				break
+			}
+		}
+	}
+	return set, vlink, nil
+}
+
+// linkByName returns the named link, or an error wrapping
+// ErrInterfaceNotFound if there is none.
+func (m *Manager) linkByName(name string) (netlink.Link, error) {
+	link, err := m.Netlink.LinkByName(name)
+	var notFound netlink.LinkNotFoundError
+	if errors.As(err, &notFound) || errors.Is(err, unix.ENODEV) {
+		return nil, fmt.Errorf("%w: %v", ErrInterfaceNotFound, name)
+	}
+	return link, err
+}
+
+func anySet(set []bool) bool {
+	for _, ok := range set {
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func anyUnset(set []bool) bool {
+	for _, ok := range set {
+		if !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAll reports whether every VIP, and with AddRoute its route, is set on
+// the interface.
+func (m *Manager) HasAll() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	set, vlink, err := m.has()
+	if err != nil || anyUnset(set) {
+		return false, err
+	}
+	missing, err := m.missingRoutes(vlink)
+	return len(missing) == 0, err
+}
+
+// Release removes the VIPs from the interface.
+func (m *Manager) Release() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.logger().Debug("Releasing IP addresses")
+	err := m.releaseOn(m.Interface, m.Addrs)
+	if err == nil {
+		m.setPresent(false)
+	}
+	if m.VirtualMAC != nil {
+		if derr := m.disableVirtual(); err == nil {
+			err = derr
+		}
+	}
+	return err
+}
+
+func (m *Manager) releaseOn(iface string, vaddrs []*netlink.Addr) error {
+	atomic.AddInt64(&m.releases, 1)
+	set, vlink, err := m.hasOn(iface, vaddrs)
+	if err != nil {
+		return err
+	}
+	if vlink == nil {
+		return nil
+	}
+	rerr := m.releaseRoutes(vlink, vaddrs)
+	for i, vaddr := range vaddrs {
+		if !set[i] {
+			m.logger().Debugf("IP address %v not found", vaddr)
+			continue
+		}
+		if err := m.addrDel(vlink, vaddr); err != nil {
+			m.logger().Errorf("Failed to release IP address %v: %v", vaddr, err)
+			if rerr == nil {
+				rerr = &AddrError{Kind: ErrAddrDelFailed, Addr: vaddr, Interface: iface, Err: err}
+			}
+			continue
+		}
+		m.logger().Infof("IP address %v released", vaddr)
+	}
+	if err := m.verifyReleased(iface, vlink, vaddrs); err != nil && rerr == nil {
+		rerr = err
+	}
+	return rerr
+}
+
+// verifyReleased checks vaddrs are gone from iface after removing them, so
+// the successor never claims one that is still here. A removal can be
+// reported done while the address stays, or something adds it right back;
+// those are removed again up to NetlinkRetries+1 times.
+func (m *Manager) verifyReleased(iface string, vlink netlink.Link, vaddrs []*netlink.Addr) error {
+	for attempt := 0; ; attempt++ {
+		set, _, err := m.hasOn(iface, vaddrs)
+		if err != nil {
+			m.logger().Warnf("Failed to check the IP addresses were released: %v", err)
+			return nil
+		}
+		var left []*netlink.Addr
+		for i, vaddr := range vaddrs {
+			if set[i] {
+				left = append(left, vaddr)
+			}
+		}
+		if len(left) == 0 {
+			return nil
+		}
+		if attempt > m.NetlinkRetries {
+			return fmt.Errorf("%w: %v still set after removing it %d times", ErrAddrDelFailed, m.joinAddrs(left), attempt+1)
+		}
+		for _, vaddr := range left {
+			m.logger().Warnf("IP address %v still set after removing it, removing it again", vaddr)
+			if err := m.Netlink.AddrDel(vlink, vaddr); err != nil {
+				m.logger().Warnf("Failed to remove IP address %v: %v", vaddr, err)
+			}
+		}
+		time.Sleep(m.NetlinkRetryInterval)
+	}
+}
+
+// Ensure sets every VIP on the interface and announces the ones it added. If
+// any of them can't be added, the ones added by this call are removed again
+// so the VIPs are never left half-claimed. It reports whether any address
+// was added.
+func (m *Manager) Ensure() (bool, error) {
+	m.mu.Lock()
+	added, err := m.ensure()
+	b := m.newBurst(added, m.ARPCount)
+	m.mu.Unlock()
+	if err != nil || len(added) == 0 {
+		return false, err
+	}
+	m.announceAdded(b)
+	return true, nil
+}
+
+// ensure sets the VIPs and returns the ones it added, which the caller
+// announces once it unlocked mu.
+func (m *Manager) ensure() ([]*netlink.Addr, error) {
+	m.logger().Debug("Ensuring IP addresses")
+	set, vlink, err := m.has()
+	if err != nil {
+		return nil, err
+	}
+	if vlink == nil {
+		if vlink, err = m.createLink(); err != nil {
+			return nil, err
+		}
+	} else if err := m.checkVirtual(vlink); err != nil {
+		return nil, err
+	} else if vlink.Attrs().Flags&net.FlagUp == 0 {
+		// An address on a down link is set but unusable
+		if err := m.Netlink.LinkSetUp(vlink); err != nil {
+			return nil, err
+		}
+		if m.VirtualMAC != nil {
+			m.logger().Infof("Brought up %v", vlink.Attrs().Name)
+		} else {
+			m.logger().Warn("Interface was down, brought it up")
+		}
+	}
+	if err := m.setARPBehavior(vlink); err != nil {
+		return nil, err
+	}
+	var added []*netlink.Addr
+	for i, vaddr := range m.Addrs {
+		if set[i] {
+			m.logger().Debugf("IP address %v already set", vaddr)
+			continue
+		}
+		err := m.checkConflict(vaddr)
+		if err == nil {
+			err = m.retry("add IP address "+vaddr.IPNet.String(), func() error {
+				return m.Netlink.AddrAdd(vlink, m.withOptions(vaddr))
+			})
+			if err != nil {
+				err = &AddrError{Kind: ErrAddrAddFailed, Addr: vaddr, Interface: m.Interface, Err: err}
+			}
+		}
+		if err != nil {
+			m.rollback(vlink, added)
+			return nil, err
+		}
+		added = append(added, vaddr)
+	}
+	if err := m.ensureRoutes(vlink); err != nil {
+		m.rollback(vlink, added)
+		return nil, err
+	}
+	if len(added) > 0 {
+		m.setPresent(true)
+	}
+	return added, nil
+}
+
+// announceAdded announces the addresses ensure added in b, after ARPDelay if
+// it is set.
+func (m *Manager) announceAdded(b arpBurst) {
+	if m.ARPDelay > 0 {
+		m.logger().Infof("IP addresses set, sending gratuitous ARPs and neighbor advertisements in %v", m.ARPDelay)
+		go m.announceLater(b.addrs)
+		return
+	}
+	m.logger().Info("IP addresses set, sending gratuitous ARPs and neighbor advertisements")
+	m.announceTargets(b)
+	m.announce(b)
+}
+
+// announceLater announces the ones of added that are still set after
+// ARPDelay.
+func (m *Manager) announceLater(added []*netlink.Addr) {
+	time.Sleep(m.ARPDelay)
+	m.mu.Lock()
+	set, _, err := m.hasOn(m.Interface, added)
+	var addrs []*netlink.Addr
+	for i, a := range added {
+		if err == nil && set[i] {
+			addrs = append(addrs, a)
+		}
+	}
+	b := m.newBurst(addrs, m.ARPCount)
+	m.mu.Unlock()
+	if err != nil {
+		m.arpLogger().Warnf("Failed to check IP addresses before sending gratuitous ARPs: %v", err)
+		return
+	}
+	if len(addrs) == 0 {
+		m.arpLogger().Info("IP addresses released before sending gratuitous ARPs")
+		return
+	}
+	m.arpLogger().Info("Sending gratuitous ARPs and neighbor advertisements")
+	m.announceTargets(b)
+	m.announce(b)
+}
+
+// rollback removes the addresses ensure added before failing.
+func (m *Manager) rollback(vlink netlink.Link, added []*netlink.Addr) {
+	for _, a := range added {
+		if err := m.addrDel(vlink, a); err != nil {
+			m.logger().Errorf("Failed to roll back IP address %v: %v", a, err)
+		}
+	}
+}
+
+// addrDel removes vaddr from vlink, retrying like retry.
+func (m *Manager) addrDel(vlink netlink.Link, vaddr *netlink.Addr) error {
+	return m.retry("remove IP address "+vaddr.IPNet.String(), func() error {
+		return m.Netlink.AddrDel(vlink, vaddr)
+	})
+}
+
+// retry runs the netlink operation fn, described by what, retrying it up to
+// NetlinkRetries times with a backoff.
+func (m *Manager) retry(what string, fn func() error) error {
+	interval := m.NetlinkRetryInterval
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > m.NetlinkRetries {
+			return err
+		}
+		m.logger().Warnf("Failed to %v, retrying in %v (%d/%d): %v", what, interval, attempt, m.NetlinkRetries, err)
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// SetARP changes the number of and the interval between gratuitous ARPs.
+func (m *Manager) SetARP(count int, interval time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ARPCount = count
+	m.ARPInterval = interval
+}
+
+// Replace switches to the VIPs in CIDR notation on iface. If the current VIPs
+// are set, the new ones are set before the old ones are removed so a leader
+// keeps serving throughout.
+func (m *Manager) Replace(vips []string, iface string) error {
+	vaddrs, err := parseAddrs(m.Netlink, vips)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	b, err := m.replace(vaddrs, iface)
+	m.mu.Unlock()
+	if len(b.addrs) > 0 {
+		m.announceAdded(b)
+	}
+	return err
+}
+
+// replace is Replace with mu held, it returns the burst for the addresses it
+// added.
+func (m *Manager) replace(vaddrs []*netlink.Addr, iface string) (arpBurst, error) {
+	oldAddrs, oldIface := m.Addrs, m.Interface
+	set, _, err := m.hasOn(oldIface, oldAddrs)
+	if err != nil {
+		return arpBurst{}, err
+	}
+
+	m.setTarget(vaddrs, iface)
+	if !anySet(set) {
+		return arpBurst{}, nil
+	}
+	m.logger().Infof("Replacing IP addresses %v on %v", m.joinAddrs(oldAddrs), oldIface)
+	added, err := m.ensure()
+	if err != nil {
+		m.setTarget(oldAddrs, oldIface)
+		return arpBurst{}, err
+	}
+	var stale []*netlink.Addr
+	for _, a := range oldAddrs {
+		if iface != oldIface || !containsAddr(addrValues(vaddrs), *a) {
+			stale = append(stale, a)
+		}
+	}
+	// Released first, so the burst counts that release
+	err = m.releaseOn(oldIface, stale)
+	return m.newBurst(added, m.ARPCount), err
+}
+
+func (m *Manager) setTarget(vaddrs []*netlink.Addr, iface string) {
+	m.Addrs = vaddrs
+	m.Interface = iface
+	m.names.Store(m.newNames())
+}
+
+func addrValues(vaddrs []*netlink.Addr) []netlink.Addr {
+	v := make([]netlink.Addr, len(vaddrs))
+	for i, a := range vaddrs {
+		v[i] = *a
+	}
+	return v
+}
+
+// withOptions returns a copy of vaddr with the label, scope and lifetime of m.
+func (m *Manager) withOptions(vaddr *netlink.Addr) *netlink.Addr {
+	a := *vaddr
+	a.Label = m.Label
+	a.Scope = m.Scope
+	if m.PreferredLifetime > 0 {
+		a.PreferedLft = int(m.PreferredLifetime.Seconds())
+		// The address stays valid, it is only no longer preferred
+		a.ValidLft = infiniteLifetime
+	}
+	return &a
+}
+
+// ParseScope returns the address scope named s: global, site, link or host.
+func ParseScope(s string) (int, error) {
+	switch s {
+	case "global", "":
+		return unix.RT_SCOPE_UNIVERSE, nil
+	case "site":
+		return unix.RT_SCOPE_SITE, nil
+	case "link":
+		return unix.RT_SCOPE_LINK, nil
+	case "host":
+		return unix.RT_SCOPE_HOST, nil
+	}
+	return 0, fmt.Errorf("unknown address scope %q", s)
+}
+
+// checkConflict returns an error if another host answers ARP requests for
+// vaddr.
+func (m *Manager) checkConflict(vaddr *netlink.Addr) error {
+	if !m.ConflictCheck || vaddr.IP.To4() == nil {
+		return nil
+	}
+	var mac net.HardwareAddr
+	err := m.inNamespace(func() (err error) {
+		mac, err = pingARP(context.Background(), vaddr.IP, m.Interface, m.ConflictTimeout)
+		return err
+	})
+	if err == arping.ErrTimeout {
+		return nil
+	}
+	if err != nil {
+		m.arpLogger().Warnf("Conflict check for %v failed: %v", vaddr.IP, err)
+		return nil
+	}
+	conflicts.WithLabelValues(m.Group).Inc()
+	m.arpLogger().Errorf("IP address %v is already in use by %v, refusing to set it", vaddr.IP, mac)
+	return fmt.Errorf("%w: %v is in use by %v", ErrAddrConflict, vaddr.IP, mac)
+}
+
+func (m *Manager) createLink() (netlink.Link, error) {
+	if m.VirtualMAC != nil {
+		return m.createVirtual()
+	}
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = m.Interface
+	err := m.Netlink.LinkAdd(&netlink.GenericLink{LinkAttrs: attrs, LinkType: m.InterfaceType})
+	// Another instance may have just created it
+	if err != nil && !errors.Is(err, unix.EEXIST) {
+		return nil, err
+	}
+	vlink, err := m.Netlink.LinkByName(m.Interface)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Netlink.LinkSetUp(vlink); err != nil {
+		return nil, err
+	}
+	m.logger().Infof("Created %v interface", m.InterfaceType)
+	return vlink, nil
+}
+
+// Announce sends one gratuitous ARP, or unsolicited neighbor advertisement
+// for IPv6, for each VIP.
+func (m *Manager) Announce() {
+	m.mu.Lock()
+	b := m.newBurst(m.Addrs, 1)
+	m.mu.Unlock()
+	m.announce(b)
+}
+
+// announceAll sends ARPCount rounds of gratuitous ARPs for all VIPs, like
+// after setting them.
+func (m *Manager) announceAll() {
+	m.mu.Lock()
+	b := m.newBurst(m.Addrs, m.ARPCount)
+	m.mu.Unlock()
+	m.announceTargets(b)
+	m.announce(b)
+}
+
+// arpBurst is a copy of what announce needs of the settings Replace and
+// SetARP change, taken with mu held.
+type arpBurst struct {
+	addrs    []*netlink.Addr
+	count    int
+	interval time.Duration
+	ifaces   []string
+	releases int64
+}
+
+func (m *Manager) newBurst(addrs []*netlink.Addr, count int) arpBurst {
+	return arpBurst{
+		addrs:    addrs,
+		count:    count,
+		interval: m.ARPInterval,
+		ifaces:   m.arpInterfaces(),
+		releases: atomic.LoadInt64(&m.releases),
+	}
+}
+
+// announce sends b.count rounds of gratuitous ARPs for b.addrs, b.interval
+// apart. It stops early when VIPs are released meanwhile, rather than
+// announcing addresses a successor may hold by now.
+func (m *Manager) announce(b arpBurst) {
+	addrs, count, ifaces := b.addrs, b.count, b.ifaces
+	if m.DryRun {
+		m.arpLogger().Infof("Dry run: would send %d gratuitous ARPs for %d addresses", count, len(addrs))
+		return
+	}
+	if count > 0 {
+		atomic.AddInt64(&m.bursts, 1)
+	}
+	members := make([][]string, len(ifaces))
+	macs := make([]net.HardwareAddr, len(ifaces))
+	for i, iface := range ifaces {
+		members[i], macs[i] = m.arpMembers(iface)
+	}
+	ops := m.arpOps()
+	sent, failed := 0, 0
+	result := func(err error, format string, a ...interface{}) {
+		if err != nil {
+			m.arpLogger().Warnf("Failed to send "+format+": %v", append(a, err)...)
+			arpFailures.WithLabelValues(m.Group).Inc()
+			failed++
+			return
+		}
+		arpSent.WithLabelValues(m.Group).Inc()
+		sent++
+	}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(b.interval)
+		}
+		if atomic.LoadInt64(&m.releases) != b.releases {
+			m.arpLogger().Debug("IP addresses released, stopping the gratuitous ARPs")
+			break
+		}
+		for _, vaddr := range addrs {
+			for j, iface := range ifaces {
+				if vaddr.IP.To4() == nil {
+					err := m.inNamespace(func() error { return unsolicitedNA(vaddr.IP, iface) })
+					result(err, "neighbor advertisement for %v on %v", vaddr.IP, iface)
+					continue
+				}
+				if members[j] == nil && m.ARPSource == nil && len(ops) == 1 && ops[0] == arpOpRequest {
+					err := m.inNamespace(func() error { return arping.GratuitousArpOverIfaceByName(vaddr.IP, iface) })
+					result(err, "gratuitous ARP for %v on %v", vaddr.IP, iface)
+					continue
+				}
+				out := members[j]
+				if out == nil {
+					out = []string{iface}
+				}
+				for _, member := range out {
+					for _, op := range ops {
+						err := m.inNamespace(func() error { return gratuitousARP(op, vaddr.IP, m.ARPSource, macs[j], member) })
+						result(err, "gratuitous ARP for %v on %v", vaddr.IP, member)
+					}
+				}
+			}
+		}
+	}
+	var failing int32
+	if failed > 0 && sent == 0 {
+		m.arpLogger().Errorf("None of the %d gratuitous ARPs and neighbor advertisements went out, the VIPs may not be announced", failed)
+		failing = 1
+	}
+	atomic.StoreInt32(&m.arpFailing, failing)
+}
+
+// arpInterfaces returns the links the gratuitous ARPs go out, ARPInterfaces
+// or else Interface.
+func (m *Manager) arpInterfaces() []string {
+	if len(m.ARPInterfaces) > 0 {
+		return m.ARPInterfaces
+	}
+	return []string{m.Interface}
+}
+
+// ARPFailing reports whether none of the gratuitous ARPs and neighbor
+// advertisements of the last round went out, so the VIPs may be set but not
+// announced.
+func (m *Manager) ARPFailing() bool {
+	return atomic.LoadInt32(&m.arpFailing) == 1
+}
+
+// currentNames returns the VIPs and interface for logs and hooks, which may
+// be read while Replace is changing them.
+func (m *Manager) currentNames() names {
+	if n, ok := m.names.Load().(names); ok {
+		return n
+	}
+	n := m.newNames()
+	m.names.Store(n)
+	return n
+}
+
+func (m *Manager) newNames() names {
+	vip := m.joinAddrs(m.Addrs)
+	fields := log.Fields{"vip": vip, "vif": m.Interface}
+	if m.Group != "" {
+		fields["group"] = m.Group
+	}
+	return names{
+		vip: vip,
+		vif: m.Interface,
+		log: log.WithFields(fields),
+	}
+}
+
+func (m *Manager) joinAddrs(vaddrs []*netlink.Addr) string {
+	s := make([]string, len(vaddrs))
+	for i, a := range vaddrs {
+		s[i] = a.IPNet.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// logger returns the logger of the reconcile component with the fields of m.
+func (m *Manager) logger() *log.Entry {
+	return m.componentLogger(LogReconcile)
+}
+
+// arpLogger is logger for the arp component.
+func (m *Manager) arpLogger() *log.Entry {
+	return m.componentLogger(LogARP)
+}
+
+func (m *Manager) componentLogger(component string) *log.Entry {
+	e := m.currentNames().log
+	if l := componentLog(component); l != log.StandardLogger() {
+		return l.WithFields(e.Data)
+	}
+	return e
+}
+
+// String returns the VIPs separated by commas.
+func (m *Manager) String() string {
+	return m.currentNames().vip
+}
+
+// InterfaceName returns the name of the interface the VIPs are set on. Unlike
+// Interface it is safe to call while Replace may be changing it.
+func (m *Manager) InterfaceName() string {
+	return m.currentNames().vif
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/retinadata/govip/vip"
+	"github.com/retinadata/govip/vip/viptest"
+	"github.com/vishvananda/netlink"
+)
+
+// These tests run the Manager against the kernel in network namespaces of
+// their own and are skipped without the privileges to create them.
+
+// newNamespace returns a new Namespace that is removed after the test, or
+// skips the test if it can't be created.
+func newNamespace(t *testing.T) *viptest.Namespace {
+	t.Helper()
+	ns, err := viptest.NewNamespace("govip0", "govip1")
+	if errors.Is(err, viptest.ErrNotRoot) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ns.Close() })
+	return ns
+}
+
+// addAddr sets the address s in CIDR notation on the named link of ns.
+func addAddr(t *testing.T, ns *viptest.Namespace, name, s string) {
+	t.Helper()
+	link, err := ns.LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := netlink.ParseAddr(s)
+	if err := ns.AddrAdd(link, a); err != nil {
+		t.Fatalf("adding %v to %v: %v", s, name, err)
+	}
+}
+
+func TestManagerNamespace(t *testing.T) {
+	if err := viptest.CheckManager(); errors.Is(err, viptest.ErrNotRoot) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManagerReadd(t *testing.T) {
+	ns := newNamespace(t)
+	m, err := vip.NewManagerWith(ns, []string{"10.254.0.1/32", "fd00:254::1/128"}, ns.Link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ARPCount = 0
+	if added, err := m.Ensure(); !added || err != nil {
+		t.Fatalf("Ensure: added %v, %v", added, err)
+	}
+
+	// Removed behind the Manager's back, e.g. by a network restart
+	link, _ := ns.LinkByName(ns.Link)
+	a, _ := netlink.ParseAddr("10.254.0.1/32")
+	if err := ns.AddrDel(link, a); err != nil {
+		t.Fatal(err)
+	}
+	if all, err := m.HasAll(); all || err != nil {
+		t.Fatalf("HasAll after removing one outside: %v, %v", all, err)
+	}
+	if added, err := m.Ensure(); !added || err != nil {
+		t.Fatalf("Ensure again: added %v, %v", added, err)
+	}
+	if all, err := m.HasAll(); !all || err != nil {
+		t.Errorf("HasAll after setting it again: %v, %v", all, err)
+	}
+	if err := m.Release(); err != nil {
+		t.Errorf("Release: %v", err)
+	}
+}
+
+func TestManagerConflict(t *testing.T) {
+	ns := newNamespace(t)
+	// The peer answers ARP requests for 10.254.0.1, arping sends them from
+	// Link's address in the same subnet. That is local to the namespace as
+	// well, which the peer only accepts as a source with accept_local.
+	addAddr(t, ns, ns.Link, "10.254.0.2/24")
+	addAddr(t, ns, ns.Peer, "10.254.0.1/24")
+	err := ns.Do(func() error {
+		return os.WriteFile("/proc/sys/net/ipv4/conf/"+ns.Peer+"/accept_local", []byte("1"), 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := vip.NewManagerWith(ns, []string{"10.254.0.1/32"}, ns.Link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ARPCount = 0
+	m.ConflictCheck = true
+	m.ConflictTimeout = 500 * time.Millisecond
+	if added, err := m.Ensure(); added || !errors.Is(err, vip.ErrAddrConflict) {
+		t.Fatalf("Ensure: added %v, %v, want an ErrAddrConflict", added, err)
+	}
+	if set, _, err := m.Has(); err != nil || set[0] {
+		t.Errorf("Has after the conflict: %v, %v, want it not set", set, err)
+	}
+
+	// Nobody answers for this one
+	m, err = vip.NewManagerWith(ns, []string{"10.254.0.9/32"}, ns.Link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ARPCount = 0
+	m.ConflictCheck = true
+	m.ConflictTimeout = 500 * time.Millisecond
+	if added, err := m.Ensure(); !added || err != nil {
+		t.Fatalf("Ensure without a conflict: added %v, %v", added, err)
+	}
+}
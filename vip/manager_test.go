@@ -0,0 +1,215 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/retinadata/govip/vip"
+	"github.com/retinadata/govip/vip/viptest"
+	"github.com/vishvananda/netlink"
+)
+
+// newManager returns a Manager for vips on eth0 of a NetLinker fake, which
+// retries quickly and sends no ARPs.
+func newManager(t *testing.T, nl vip.NetLinker, vips ...string) *vip.Manager {
+	t.Helper()
+	m, err := vip.NewManagerWith(nl, vips, "eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ARPCount = 0
+	m.NetlinkRetries = 1
+	m.NetlinkRetryInterval = time.Millisecond
+	return m
+}
+
+// addrs returns the addresses on the named link of nl in CIDR notation.
+func addrs(nl *viptest.NetLinker, link string) []string {
+	var list []string
+	for _, a := range nl.Addrs(link) {
+		list = append(list, a.IPNet.String())
+	}
+	return list
+}
+
+func TestEnsureRollsBack(t *testing.T) {
+	nl := viptest.NewNetLinker("eth0")
+	failed := errors.New("no buffer space available")
+	nl.AddErr = func(a *netlink.Addr) error {
+		if a.IPNet.String() == "10.0.0.2/32" {
+			return failed
+		}
+		return nil
+	}
+	m := newManager(t, nl, "10.0.0.1/32", "10.0.0.2/32", "fd00::1/128")
+	// Set before Ensure, so it must stay
+	link, _ := nl.LinkByName("eth0")
+	a, _ := netlink.ParseAddr("fd00::1/128")
+	if err := nl.AddrAdd(link, a); err != nil {
+		t.Fatal(err)
+	}
+
+	added, err := m.Ensure()
+	if added || !errors.Is(err, vip.ErrAddrAddFailed) || !errors.Is(err, failed) {
+		t.Fatalf("Ensure: added %v, %v, want an ErrAddrAddFailed", added, err)
+	}
+	var aerr *vip.AddrError
+	if !errors.As(err, &aerr) || aerr.Addr.IPNet.String() != "10.0.0.2/32" || aerr.Interface != "eth0" {
+		t.Errorf("Ensure: %#v, want an AddrError for 10.0.0.2/32 on eth0", aerr)
+	}
+	if got := addrs(nl, "eth0"); len(got) != 1 || got[0] != "fd00::1/128" {
+		t.Errorf("addresses left: %v, want only fd00::1/128", got)
+	}
+	if m.Present() {
+		t.Error("Present after a failed Ensure")
+	}
+}
+
+func TestEnsureRelease(t *testing.T) {
+	nl := viptest.NewNetLinker("eth0")
+	m := newManager(t, nl, "10.0.0.1/32", "fd00::1/128")
+
+	if added, err := m.Ensure(); !added || err != nil {
+		t.Fatalf("Ensure: added %v, %v", added, err)
+	}
+	if got := addrs(nl, "eth0"); len(got) != 2 {
+		t.Fatalf("addresses after Ensure: %v", got)
+	}
+	if added, err := m.Ensure(); added || err != nil {
+		t.Errorf("Ensure again: added %v, %v, want nothing added", added, err)
+	}
+	if err := m.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if got := addrs(nl, "eth0"); len(got) != 0 {
+		t.Errorf("addresses after Release: %v", got)
+	}
+	if m.Present() {
+		t.Error("Present after Release")
+	}
+	// Nothing left to remove
+	if err := m.Release(); err != nil {
+		t.Errorf("Release again: %v", err)
+	}
+}
+
+// stickyNetLinker reports the first misses removals done without removing
+// anything, like an address added right back.
+type stickyNetLinker struct {
+	*viptest.NetLinker
+	misses int
+}
+
+func (n *stickyNetLinker) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	if n.misses > 0 {
+		n.misses--
+		return nil
+	}
+	return n.NetLinker.AddrDel(link, addr)
+}
+
+func TestReleaseRemovesAgain(t *testing.T) {
+	nl := &stickyNetLinker{NetLinker: viptest.NewNetLinker("eth0")}
+	m := newManager(t, nl, "10.0.0.1/32")
+	if _, err := m.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+
+	nl.misses = 2
+	if err := m.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if got := addrs(nl.NetLinker, "eth0"); len(got) != 0 {
+		t.Errorf("addresses after Release: %v", got)
+	}
+}
+
+func TestReleaseStillSet(t *testing.T) {
+	nl := &stickyNetLinker{NetLinker: viptest.NewNetLinker("eth0")}
+	m := newManager(t, nl, "10.0.0.1/32")
+	if _, err := m.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+
+	nl.misses = 100
+	if err := m.Release(); !errors.Is(err, vip.ErrAddrDelFailed) {
+		t.Fatalf("Release: %v, want an ErrAddrDelFailed", err)
+	}
+	if got := addrs(nl.NetLinker, "eth0"); len(got) != 1 {
+		t.Errorf("addresses after Release: %v, want the stuck one", got)
+	}
+}
+
+func TestReleaseDuringBurst(t *testing.T) {
+	// No such interface on the host, the ARPs fail right away
+	nl := viptest.NewNetLinker("govip-test0")
+	m, err := vip.NewManagerWith(nl, []string{"10.0.0.1/32"}, "govip-test0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ARPCount = 50
+	m.ARPInterval = 100 * time.Millisecond
+
+	ensured := make(chan error, 1)
+	go func() {
+		_, err := m.Ensure()
+		ensured <- err
+	}()
+	for !m.Present() {
+		time.Sleep(time.Millisecond)
+	}
+	released := make(chan error, 1)
+	go func() { released <- m.Release() }()
+	select {
+	case err := <-released:
+		if err != nil {
+			t.Fatalf("Release: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Release waited for the gratuitous ARPs")
+	}
+	select {
+	case err := <-ensured:
+		if err != nil {
+			t.Errorf("Ensure: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("the gratuitous ARPs went on after Release")
+	}
+}
+
+func TestHasMissingInterface(t *testing.T) {
+	nl := viptest.NewNetLinker("eth0")
+	m, err := vip.NewManagerWith(nl, []string{"10.0.0.1/32"}, "eth1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.Has(); !errors.Is(err, vip.ErrInterfaceNotFound) {
+		t.Errorf("Has: %v, want an ErrInterfaceNotFound", err)
+	}
+	if _, err := m.Ensure(); !errors.Is(err, vip.ErrInterfaceNotFound) {
+		t.Errorf("Ensure: %v, want an ErrInterfaceNotFound", err)
+	}
+
+	// It doesn't have to exist yet if it is created
+	m.CreateInterface = true
+	set, link, err := m.Has()
+	if err != nil || link != nil || len(set) != 1 || set[0] {
+		t.Errorf("Has with CreateInterface: %v, %v, %v, want nothing set", set, link, err)
+	}
+}
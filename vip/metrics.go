@@ -0,0 +1,234 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// All metrics but the etcd ones, which are shared by the groups, have a
+// group label with the Manager's Group, empty unless several groups run in
+// one process.
+var (
+	isLeader = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "govip_is_leader",
+		Help: "Whether this govip is the election leader.",
+	}, []string{"group"})
+	failovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "govip_failovers_total",
+		Help: "Number of times this govip became the leader.",
+	}, []string{"group"})
+	leaderChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "govip_leader_changes_total",
+		Help: "Number of times this govip became the leader or stopped being it.",
+	}, []string{"group"})
+	leaderTerms = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "govip_leader_term_seconds",
+		Help:    "Duration of the terms this govip was the leader for.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+	}, []string{"group"})
+	readds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "govip_vip_readds_total",
+		Help: "Number of times a VIP was found missing while leader and set again.",
+	}, []string{"group"})
+	arpSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "govip_arp_sent_total",
+		Help: "Number of gratuitous ARPs and unsolicited neighbor advertisements sent.",
+	}, []string{"group"})
+	arpFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "govip_arp_failures_total",
+		Help: "Number of gratuitous ARPs and unsolicited neighbor advertisements that failed to send.",
+	}, []string{"group"})
+	vipPresent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "govip_vip_present",
+		Help: "Whether all VIPs were set on the interface at the last check.",
+	}, []string{"group"})
+	conflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "govip_conflicts_total",
+		Help: "Number of times a VIP was found in use by another host before setting it.",
+	}, []string{"group"})
+	campaigns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "govip_campaigns_total",
+		Help: "Number of campaigns for the leadership started.",
+	}, []string{"group"})
+	campaignTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "govip_campaign_timeouts_total",
+		Help: "Number of campaigns abandoned after the campaign timeout.",
+	}, []string{"group"})
+	interference = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "govip_vip_interference_total",
+		Help: "Number of times the VIPs had to be set again more often than the re-add limit allows.",
+	}, []string{"group"})
+	splitBrains = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "govip_splitbrain_suspected_total",
+		Help: "Number of times the backend named another leader while this govip held the VIPs.",
+	}, []string{"group"})
+	etcdConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "govip_etcd_connected",
+		Help: "Whether the etcd client has a ready connection.",
+	})
+	etcdSessions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "govip_etcd_session_epoch",
+		Help: "Number of etcd sessions created, a new one follows each expiry.",
+	})
+	leaderTime = &leaderClocks{
+		desc: prometheus.NewDesc("govip_leader_seconds_total",
+			"Total time spent as the leader in seconds.", []string{"group"}, nil),
+		changedDesc: prometheus.NewDesc("govip_leader_change_age_seconds",
+			"Seconds since this govip became the leader or stopped being it, or since it started.", []string{"group"}, nil),
+		clocks: map[string]*leaderClock{},
+	}
+)
+
+func init() {
+	prometheus.MustRegister(isLeader, failovers, leaderChanges, leaderTerms,
+		arpSent, arpFailures, vipPresent, conflicts, readds, campaigns, campaignTimeouts,
+		interference, splitBrains, etcdConnected, etcdSessions, leaderTime)
+}
+
+// leaderClocks collects a leaderClock per group. The values are computed
+// on every scrape so they keep growing between changes.
+type leaderClocks struct {
+	desc        *prometheus.Desc
+	changedDesc *prometheus.Desc
+	mu          sync.Mutex
+	clocks      map[string]*leaderClock
+}
+
+func (c *leaderClocks) get(group string) *leaderClock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clock, ok := c.clocks[group]
+	if !ok {
+		clock = &leaderClock{changed: time.Now()}
+		c.clocks[group] = clock
+	}
+	return clock
+}
+
+func (c *leaderClocks) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+	ch <- c.changedDesc
+}
+
+func (c *leaderClocks) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	groups := make([]string, 0, len(c.clocks))
+	for g := range c.clocks {
+		groups = append(groups, g)
+	}
+	c.mu.Unlock()
+	sort.Strings(groups)
+	for _, g := range groups {
+		clock := c.get(g)
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, clock.seconds(), g)
+		ch <- prometheus.MustNewConstMetric(c.changedDesc, prometheus.GaugeValue, clock.sinceChange(), g)
+	}
+}
+
+// leaderClock accumulates the time spent as the leader and remembers when
+// that last started or stopped.
+type leaderClock struct {
+	mu      sync.Mutex
+	total   time.Duration
+	since   time.Time
+	changed time.Time
+}
+
+// start starts a term, it returns false if one is running already.
+func (c *leaderClock) start() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.since.IsZero() {
+		return false
+	}
+	c.since = time.Now()
+	c.changed = c.since
+	return true
+}
+
+// stop ends the running term and returns its duration, or false if there is
+// none.
+func (c *leaderClock) stop() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.since.IsZero() {
+		return 0, false
+	}
+	now := time.Now()
+	term := now.Sub(c.since)
+	c.total += term
+	c.since = time.Time{}
+	c.changed = now
+	return term, true
+}
+
+func (c *leaderClock) sinceChange() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.changed).Seconds()
+}
+
+func (c *leaderClock) seconds() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d := c.total
+	if !c.since.IsZero() {
+		d += time.Since(c.since)
+	}
+	return d.Seconds()
+}
+
+// initMetrics exports the metrics of group before anything happened to it.
+func initMetrics(group string) {
+	for _, v := range []*prometheus.GaugeVec{isLeader, vipPresent} {
+		v.WithLabelValues(group)
+	}
+	for _, v := range []*prometheus.CounterVec{failovers, leaderChanges, arpSent, arpFailures, conflicts, readds, campaigns, campaignTimeouts, interference, splitBrains} {
+		v.WithLabelValues(group)
+	}
+	leaderTerms.WithLabelValues(group)
+	leaderTime.get(group)
+}
+
+// recordLeader records a leadership change of group in the metrics. Calls
+// that don't change anything, e.g. giving up the leadership again after a
+// session expired, aren't counted.
+func recordLeader(group string, leader bool) {
+	if leader {
+		isLeader.WithLabelValues(group).Set(1)
+		if leaderTime.get(group).start() {
+			failovers.WithLabelValues(group).Inc()
+			leaderChanges.WithLabelValues(group).Inc()
+		}
+		return
+	}
+	isLeader.WithLabelValues(group).Set(0)
+	if term, ok := leaderTime.get(group).stop(); ok {
+		leaderChanges.WithLabelValues(group).Inc()
+		leaderTerms.WithLabelValues(group).Observe(term.Seconds())
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
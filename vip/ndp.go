@@ -0,0 +1,70 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"net"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	naFlagOverride    = 0x20
+	ndOptTargetLLAddr = 2
+)
+
+// unsolicitedNA sends an unsolicited neighbor advertisement for ip to the
+// all-nodes multicast group, the IPv6 counterpart of a gratuitous ARP.
+func unsolicitedNA(ip net.IP, ifname string) error {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return err
+	}
+
+	// Flags, target address and a target link-layer address option
+	body := make([]byte, 4+net.IPv6len+8)
+	body[0] = naFlagOverride
+	copy(body[4:], ip.To16())
+	opt := body[4+net.IPv6len:]
+	opt[0] = ndOptTargetLLAddr
+	opt[1] = 1
+	copy(opt[2:], iface.HardwareAddr)
+
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeNeighborAdvertisement,
+		Body: &icmp.RawBody{Data: body},
+	}
+	// The kernel fills in the checksum on ICMPv6 sockets
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	c, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	p := c.IPv6PacketConn()
+	if err := p.SetMulticastHopLimit(255); err != nil {
+		return err
+	}
+	if err := p.SetMulticastInterface(iface); err != nil {
+		return err
+	}
+	_, err = p.WriteTo(b, nil, &net.IPAddr{IP: net.IPv6linklocalallnodes, Zone: ifname})
+	return err
+}
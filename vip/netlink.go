@@ -0,0 +1,275 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// NetLinker is the subset of netlink used to manage the VIPs, so the logic
+// can be exercised without root or a real interface.
+type NetLinker interface {
+	ParseAddr(s string) (*netlink.Addr, error)
+	LinkByName(name string) (netlink.Link, error)
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	AddrAdd(link netlink.Link, addr *netlink.Addr) error
+	AddrDel(link netlink.Link, addr *netlink.Addr) error
+	LinkAdd(link netlink.Link) error
+	LinkSetUp(link netlink.Link) error
+	LinkSetDown(link netlink.Link) error
+	LinkSetARPOff(link netlink.Link) error
+	RouteList(link netlink.Link, family int) ([]netlink.Route, error)
+	RouteAdd(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+	// AddrSubscribe sends address changes to ch until done is closed,
+	// then closes ch.
+	AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}) error
+	// LinkSubscribe is the AddrSubscribe counterpart for link changes.
+	LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error
+}
+
+// Netlink is the NetLinker backed by the kernel.
+type Netlink struct{}
+
+func (Netlink) ParseAddr(s string) (*netlink.Addr, error) {
+	return netlink.ParseAddr(s)
+}
+
+func (Netlink) LinkByName(name string) (netlink.Link, error) {
+	return netlink.LinkByName(name)
+}
+
+func (Netlink) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	return netlink.AddrList(link, family)
+}
+
+func (Netlink) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	return netlink.AddrAdd(link, addr)
+}
+
+func (Netlink) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	return netlink.AddrDel(link, addr)
+}
+
+func (Netlink) LinkAdd(link netlink.Link) error {
+	return netlink.LinkAdd(link)
+}
+
+func (Netlink) LinkSetUp(link netlink.Link) error {
+	return netlink.LinkSetUp(link)
+}
+
+func (Netlink) LinkSetDown(link netlink.Link) error {
+	return netlink.LinkSetDown(link)
+}
+
+func (Netlink) LinkSetARPOff(link netlink.Link) error {
+	return netlink.LinkSetARPOff(link)
+}
+
+func (Netlink) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	return netlink.RouteList(link, family)
+}
+
+func (Netlink) RouteAdd(route *netlink.Route) error {
+	return netlink.RouteAdd(route)
+}
+
+func (Netlink) RouteDel(route *netlink.Route) error {
+	return netlink.RouteDel(route)
+}
+
+func (Netlink) AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}) error {
+	return netlink.AddrSubscribe(ch, done)
+}
+
+func (Netlink) LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error {
+	return netlink.LinkSubscribe(ch, done)
+}
+
+// dryRun is a NetLinker that logs changes instead of making them. It
+// remembers them, so reads reflect what would have happened.
+type dryRun struct {
+	NetLinker
+
+	mu     sync.Mutex
+	links  map[string]bool
+	macs   map[string]net.HardwareAddr
+	addrs  map[string][]netlink.Addr
+	gone   map[string][]netlink.Addr
+	routes []netlink.Route
+}
+
+// NewDryRun returns a NetLinker that reads through nl but only logs what it
+// would change.
+func NewDryRun(nl NetLinker) NetLinker {
+	return &dryRun{
+		NetLinker: nl,
+		links:     map[string]bool{},
+		macs:      map[string]net.HardwareAddr{},
+		addrs:     map[string][]netlink.Addr{},
+		gone:      map[string][]netlink.Addr{},
+	}
+}
+
+func (d *dryRun) LinkByName(name string) (netlink.Link, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.links[name] {
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = name
+		attrs.HardwareAddr = d.macs[name]
+		attrs.Flags = net.FlagUp
+		attrs.RawFlags = unix.IFF_UP | unix.IFF_LOWER_UP
+		return &netlink.Dummy{LinkAttrs: attrs}, nil
+	}
+	return d.NetLinker.LinkByName(name)
+}
+
+func (d *dryRun) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	name := link.Attrs().Name
+	var addrs []netlink.Addr
+	d.mu.Lock()
+	created := d.links[name]
+	d.mu.Unlock()
+	if !created {
+		var err error
+		if addrs, err = d.NetLinker.AddrList(link, family); err != nil {
+			return nil, err
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var list []netlink.Addr
+	for _, a := range addrs {
+		if !containsAddr(d.gone[name], a) {
+			list = append(list, a)
+		}
+	}
+	return append(list, d.addrs[name]...), nil
+}
+
+func (d *dryRun) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	name := link.Attrs().Name
+	log.Infof("Dry run: would add %v to %v", addr.IPNet, name)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.gone[name] = removeAddr(d.gone[name], *addr)
+	d.addrs[name] = append(d.addrs[name], *addr)
+	return nil
+}
+
+func (d *dryRun) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	name := link.Attrs().Name
+	log.Infof("Dry run: would remove %v from %v", addr.IPNet, name)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.addrs[name] = removeAddr(d.addrs[name], *addr)
+	d.gone[name] = append(d.gone[name], *addr)
+	return nil
+}
+
+func (d *dryRun) LinkAdd(link netlink.Link) error {
+	log.Infof("Dry run: would create %v interface %v", link.Type(), link.Attrs().Name)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.links[link.Attrs().Name] = true
+	d.macs[link.Attrs().Name] = link.Attrs().HardwareAddr
+	return nil
+}
+
+func (d *dryRun) LinkSetUp(link netlink.Link) error {
+	log.Infof("Dry run: would bring up %v", link.Attrs().Name)
+	return nil
+}
+
+func (d *dryRun) LinkSetDown(link netlink.Link) error {
+	log.Infof("Dry run: would bring down %v", link.Attrs().Name)
+	return nil
+}
+
+func (d *dryRun) LinkSetARPOff(link netlink.Link) error {
+	log.Infof("Dry run: would set NOARP on %v", link.Attrs().Name)
+	return nil
+}
+
+func (d *dryRun) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	d.mu.Lock()
+	created := d.links[link.Attrs().Name]
+	d.mu.Unlock()
+	var list []netlink.Route
+	if !created {
+		var err error
+		if list, err = d.NetLinker.RouteList(link, family); err != nil {
+			return nil, err
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, r := range d.routes {
+		if r.LinkIndex == link.Attrs().Index {
+			list = append(list, r)
+		}
+	}
+	return list, nil
+}
+
+func (d *dryRun) RouteAdd(route *netlink.Route) error {
+	log.Infof("Dry run: would add route to %v", route.Dst)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.routes = append(d.routes, *route)
+	return nil
+}
+
+func (d *dryRun) RouteDel(route *netlink.Route) error {
+	log.Infof("Dry run: would remove route to %v", route.Dst)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var list []netlink.Route
+	for _, r := range d.routes {
+		if !r.Equal(*route) {
+			list = append(list, r)
+		}
+	}
+	d.routes = list
+	return nil
+}
+
+func containsAddr(addrs []netlink.Addr, addr netlink.Addr) bool {
+	for _, a := range addrs {
+		if a.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func removeAddr(addrs []netlink.Addr, addr netlink.Addr) []netlink.Addr {
+	var list []netlink.Addr
+	for _, a := range addrs {
+		if !a.Equal(addr) {
+			list = append(list, a)
+		}
+	}
+	return list
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// Doer is implemented by NetLinkers working in another network namespace.
+// The Manager sends the ARPs and neighbor advertisements and sets the ARP
+// sysctls through Do, so they happen in that namespace as well.
+type Doer interface {
+	// Do runs fn in the namespace.
+	Do(fn func() error) error
+}
+
+// inNamespace runs fn in the namespace of Netlink if it is a Doer, as is.
+func (m *Manager) inNamespace(fn func() error) error {
+	nl := m.Netlink
+	if d, ok := nl.(*dryRun); ok {
+		nl = d.NetLinker
+	}
+	if d, ok := nl.(Doer); ok {
+		return d.Do(fn)
+	}
+	return fn()
+}
+
+// Netns is the NetLinker for a network namespace other than that of govip,
+// e.g. of a container, so a VIP can be managed in it while the backend is
+// still reached from the host. Netlink calls go through a handle in the
+// namespace, and Do switches only the calling thread into it, for as long
+// as fn runs.
+type Netns struct {
+	ns     netns.NsHandle
+	handle *netlink.Handle
+}
+
+// OpenNetns opens the network namespace name, one in /run/netns as created
+// by ip netns add, or a path such as /proc/PID/ns/net.
+func OpenNetns(name string) (*Netns, error) {
+	var (
+		ns  netns.NsHandle
+		err error
+	)
+	if strings.Contains(name, "/") {
+		ns, err = netns.GetFromPath(name)
+	} else {
+		ns, err = netns.GetFromName(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		ns.Close()
+		return nil, err
+	}
+	return &Netns{ns: ns, handle: handle}, nil
+}
+
+// Close releases the namespace, which is left as it is.
+func (n *Netns) Close() error {
+	n.handle.Close()
+	return n.ns.Close()
+}
+
+// Do runs fn with the calling thread in the namespace and switches it back
+// afterwards. Goroutines started by fn run elsewhere, outside of it.
+func (n *Netns) Do(fn func() error) error {
+	runtime.LockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer orig.Close()
+	if err := netns.Set(n.ns); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	ferr := fn()
+	if err := netns.Set(orig); err != nil {
+		// The thread stays locked, so the runtime discards it rather
+		// than running other goroutines in the wrong namespace
+		return fmt.Errorf("failed to switch back from the network namespace: %v", err)
+	}
+	runtime.UnlockOSThread()
+	return ferr
+}
+
+func (n *Netns) ParseAddr(s string) (*netlink.Addr, error) {
+	return netlink.ParseAddr(s)
+}
+
+func (n *Netns) LinkByName(name string) (netlink.Link, error) {
+	return n.handle.LinkByName(name)
+}
+
+func (n *Netns) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	return n.handle.AddrList(link, family)
+}
+
+func (n *Netns) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	return n.handle.AddrAdd(link, addr)
+}
+
+func (n *Netns) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	return n.handle.AddrDel(link, addr)
+}
+
+func (n *Netns) LinkAdd(link netlink.Link) error {
+	return n.handle.LinkAdd(link)
+}
+
+func (n *Netns) LinkSetUp(link netlink.Link) error {
+	return n.handle.LinkSetUp(link)
+}
+
+func (n *Netns) LinkSetDown(link netlink.Link) error {
+	return n.handle.LinkSetDown(link)
+}
+
+func (n *Netns) LinkSetARPOff(link netlink.Link) error {
+	return n.handle.LinkSetARPOff(link)
+}
+
+func (n *Netns) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	return n.handle.RouteList(link, family)
+}
+
+func (n *Netns) RouteAdd(route *netlink.Route) error {
+	return n.handle.RouteAdd(route)
+}
+
+func (n *Netns) RouteDel(route *netlink.Route) error {
+	return n.handle.RouteDel(route)
+}
+
+func (n *Netns) AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}) error {
+	return netlink.AddrSubscribeWithOptions(ch, done, netlink.AddrSubscribeOptions{Namespace: &n.ns})
+}
+
+func (n *Netns) LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error {
+	return netlink.LinkSubscribeWithOptions(ch, done, netlink.LinkSubscribeOptions{Namespace: &n.ns})
+}
@@ -0,0 +1,155 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Events passed to the Notifiers of a Runner.
+const (
+	EventAcquired   = "acquired"
+	EventReleased   = "released"
+	EventUnhealthy  = "demoted-unhealthy"
+	EventSplitBrain = "split-brain-suspected"
+)
+
+// notifyTimeout bounds each notification, so a hanging endpoint doesn't
+// pile up goroutines.
+const notifyTimeout = 10 * time.Second
+
+var notifyFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "govip_notify_failures_total",
+	Help: "Number of notifications that couldn't be delivered.",
+}, []string{"group", "notifier"})
+
+func init() {
+	prometheus.MustRegister(notifyFailures)
+}
+
+// Event is a change of the leadership state of a member, as sent to a
+// Notifier.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Group     string    `json:"group,omitempty"`
+	Member    string    `json:"member"`
+	Event     string    `json:"event"`
+	VIP       string    `json:"vip"`
+	Interface string    `json:"interface"`
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("govip %v: %v %v on %v", e.Member, e.Event, e.VIP, e.Interface)
+	if e.Group != "" {
+		s += " (group " + e.Group + ")"
+	}
+	return s
+}
+
+// Notifier is told about Events, e.g. to page someone on a failover. String
+// names the notifier in logs and metrics, it shouldn't contain secrets like
+// the URL of a Slack webhook.
+type Notifier interface {
+	Notify(ctx context.Context, e Event) error
+	String() string
+}
+
+// WebhookNotifier posts each Event as JSON to URL.
+type WebhookNotifier struct {
+	URL string
+}
+
+func (n WebhookNotifier) Notify(ctx context.Context, e Event) error {
+	return postJSON(ctx, n.URL, e)
+}
+
+func (n WebhookNotifier) String() string { return "webhook" }
+
+// SlackNotifier posts each Event as a message to URL, a Slack incoming
+// webhook.
+type SlackNotifier struct {
+	URL string
+}
+
+func (n SlackNotifier) Notify(ctx context.Context, e Event) error {
+	return postJSON(ctx, n.URL, struct {
+		Text string `json:"text"`
+	}{e.String()})
+}
+
+func (n SlackNotifier) String() string { return "slack" }
+
+// postJSON posts v as JSON to addr. Errors leave addr out, it may hold a
+// token.
+func postJSON(ctx context.Context, addr string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, addr, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if uerr, ok := err.(*url.Error); ok {
+		return uerr.Err
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("returned %v", resp.Status)
+	}
+	return nil
+}
+
+// notify sends event to the Notifiers. It doesn't wait for them, failures
+// are logged and counted but never hold up the VIPs.
+func (r *Runner) notify(event string) {
+	if len(r.Notifiers) == 0 {
+		return
+	}
+	e := Event{
+		Time:      time.Now().UTC(),
+		Group:     r.Manager.Group,
+		Member:    r.Member,
+		Event:     event,
+		VIP:       r.Manager.String(),
+		Interface: r.Manager.InterfaceName(),
+	}
+	if r.Manager.DryRun {
+		r.logger().Infof("Dry run: would notify %v", e.Event)
+		return
+	}
+	for _, n := range r.Notifiers {
+		go func(n Notifier) {
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			if err := n.Notify(ctx, e); err != nil {
+				r.logger().Warnf("Failed to notify %v of %v event: %v", n, event, err)
+				notifyFailures.WithLabelValues(r.Manager.Group, n.String()).Inc()
+			}
+		}(n)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"context"
+	"time"
+
+	client "go.etcd.io/etcd/client/v3"
+)
+
+// Promoter is implemented by backends that can pass a promotion hint, the
+// member an operator wants to lead, to the members of an election.
+type Promoter interface {
+	// Promote puts member under key for ttl.
+	Promote(ctx context.Context, key, member string, ttl time.Duration) error
+	// WatchPromotion sends the member under key now and whenever it
+	// changes, an empty string while there is none, until ctx is
+	// cancelled.
+	WatchPromotion(ctx context.Context, key string) <-chan string
+}
+
+// Promote puts member under key with a lease of ttl, so a hint for a member
+// that never takes over doesn't keep the others aside for good.
+func (b *Etcd) Promote(ctx context.Context, key, member string, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, b.requestTimeout())
+	defer cancel()
+	lease, err := b.Client.Grant(ctx, int64(ttl/time.Second))
+	if err != nil {
+		return err
+	}
+	_, err = b.Client.Put(ctx, key, member, client.WithLease(lease.ID))
+	return err
+}
+
+// WatchPromotion watches key like WatchConfig, but also sends an empty
+// string when it is deleted or its lease expires.
+func (b *Etcd) WatchPromotion(ctx context.Context, key string) <-chan string {
+	return b.watchValue(ctx, key)
+}
+
+// watchValue sends the value of key now and whenever it changes, an empty
+// string while it doesn't exist, getting it again after a failed watch.
+func (b *Etcd) watchValue(ctx context.Context, key string) <-chan string {
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		last := ""
+		send := func(value string) bool {
+			if value == last {
+				return true
+			}
+			select {
+			case ch <- value:
+				last = value
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if !send("") {
+			return
+		}
+		for attempt := 0; ctx.Err() == nil; {
+			gctx, cancel := context.WithTimeout(ctx, b.requestTimeout())
+			resp, err := b.Client.Get(gctx, key)
+			cancel()
+			if err != nil {
+				if !sleep(ctx, backoff(attempt)) {
+					return
+				}
+				attempt++
+				continue
+			}
+			attempt = 0
+			value := ""
+			if len(resp.Kvs) > 0 {
+				value = string(resp.Kvs[0].Value)
+			}
+			if !send(value) {
+				return
+			}
+			wctx, cancel := context.WithCancel(ctx)
+			for wresp := range b.Client.Watch(wctx, key, client.WithRev(resp.Header.Revision+1)) {
+				if wresp.Err() != nil {
+					break
+				}
+				for _, ev := range wresp.Events {
+					value := ""
+					if ev.Type == client.EventTypePut {
+						value = string(ev.Kv.Value)
+					}
+					if !send(value) {
+						cancel()
+						return
+					}
+				}
+			}
+			cancel()
+		}
+	}()
+	return ch
+}
+
+// followPromotion keeps the hint under PromoteKey until ctx is cancelled.
+func (r *Runner) followPromotion(ctx context.Context) {
+	defer r.setPromoted("")
+	p, ok := r.Backend.(Promoter)
+	if !ok {
+		r.logger().Warnf("The %v backend can't pass promotion hints, ignoring %v", r.Backend, r.PromoteKey)
+		return
+	}
+	for member := range p.WatchPromotion(ctx, r.PromoteKey) {
+		r.setPromoted(member)
+	}
+}
+
+func (r *Runner) setPromoted(member string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.promoted == member {
+		return
+	}
+	switch {
+	case member == "":
+		r.logger().Infof("The promotion of %s is over", r.promoted)
+	case member == r.Member:
+		r.logger().Info("Promoted by an operator, taking over the leadership")
+	default:
+		r.logger().Infof("%s was promoted by an operator, standing aside", member)
+	}
+	r.promoted = member
+	if r.promoteChanged != nil {
+		close(r.promoteChanged)
+		r.promoteChanged = nil
+	}
+	// Standing aside makes the runner ineligible
+	if r.pauseChanged != nil {
+		close(r.pauseChanged)
+		r.pauseChanged = nil
+	}
+}
+
+// promotion returns the member promoted by an operator, if any, and a
+// channel that is closed when it changes.
+func (r *Runner) promotion() (string, <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.promoteChanged == nil {
+		r.promoteChanged = make(chan struct{})
+	}
+	return r.promoted, r.promoteChanged
+}
+
+// promotedHere reports whether this member is the one promoted.
+func (r *Runner) promotedHere() bool {
+	member, _ := r.promotion()
+	return member == r.Member
+}
+
+// promote returns a channel that receives the candidate promoted by an
+// operator once it is waiting in line behind this leader, so the leadership
+// goes to it when this member resigns. It gives up when ctx is cancelled,
+// and is nil if the election has no line.
+func (r *Runner) promote(ctx context.Context, e Election) <-chan Candidate {
+	q, ok := e.(Queue)
+	if !ok || r.PromoteKey == "" {
+		return nil
+	}
+	ch := make(chan Candidate, 1)
+	go func() {
+		waiting := q.Waiting(ctx)
+		var (
+			line     []string
+			received bool
+			warned   string
+		)
+		for {
+			member, changed := r.promotion()
+			if member != "" && member != r.Member {
+				for _, v := range line {
+					if c := ParseCandidate(v); c.Member == member {
+						ch <- c
+						return
+					}
+				}
+				if received && warned != member {
+					r.logger().Warnf("%s was promoted but isn't campaigning, keeping the leadership until it does", member)
+					warned = member
+				}
+			}
+			select {
+			case values, ok := <-waiting:
+				if !ok {
+					return
+				}
+				line, received = values, true
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
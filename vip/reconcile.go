@@ -0,0 +1,221 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"context"
+	"time"
+)
+
+// reconcileLoop keeps the VIPs set while the runner leads and releases them
+// when it stops leading, until ctx is cancelled. During Run it is the only
+// one setting and releasing them, the election only changes isLeader.
+func (r *Runner) reconcileLoop(ctx context.Context) {
+	var tick <-chan time.Time
+	if r.ReconcileInterval > 0 {
+		t := time.NewTicker(r.ReconcileInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+	var refresh <-chan time.Time
+	if r.ARPRefreshInterval > 0 {
+		t := time.NewTicker(r.ARPRefreshInterval)
+		defer t.Stop()
+		refresh = t.C
+	}
+	// An idle loop still beats for watchStall
+	var heartbeat <-chan time.Time
+	if r.StallTimeout > 0 {
+		t := time.NewTicker(r.StallTimeout / 4)
+		defer t.Stop()
+		heartbeat = t.C
+	}
+
+	hcancel := func() {}
+	var (
+		held           bool
+		watch, removed <-chan struct{}
+		// acquired is whether the VIPs were held before during this run
+		acquired bool
+	)
+	release := func() {
+		hcancel()
+		watch, removed = nil, nil
+		if r.keeping() {
+			r.loggerFor(LogReconcile).Info("Exiting, keeping the IP addresses for the next run")
+		} else {
+			r.release()
+			r.audit("release")
+			r.notify(EventReleased)
+		}
+		held = false
+		r.setHeld(false)
+	}
+	// VIPs may be left from a previous run
+	r.Manager.HasAll()
+	for {
+		r.beat()
+		leader, changed := r.leaderState()
+		switch {
+		case leader && !held:
+			res, err := r.Manager.Ensure()
+			if err != nil {
+				r.loggerFor(LogReconcile).Errorf("Failed to set IP addresses: %v", err)
+				r.giveUp()
+				break
+			}
+			held = true
+			r.setHeld(true)
+			r.audit("acquire")
+			r.notify(EventAcquired)
+			if res {
+				runHook("acquire", r.OnAcquire, r.HookTimeout, r.Manager)
+			} else if r.ARPOnStart && !acquired {
+				r.loggerFor(LogReconcile).Info("IP addresses already set, sending gratuitous ARPs to reassert them")
+				r.Manager.announceAll()
+			}
+			acquired = true
+			hctx, cancel := context.WithCancel(ctx)
+			hcancel = cancel
+			watch = r.Manager.watchRemovals(hctx)
+			removed = watch
+		case !leader && held:
+			release()
+		}
+		r.updateHasVIP()
+
+		select {
+		case <-changed:
+		case <-tick:
+			if held {
+				r.reconcile()
+				removed = watch
+			} else if _, err := r.Manager.HasAll(); err != nil {
+				r.loggerFor(LogReconcile).Debugf("Failed to check IP addresses: %v", err)
+			}
+		case <-refresh:
+			if held {
+				r.Manager.Announce()
+			}
+		case <-heartbeat:
+		case <-removed:
+			// Failing to set the VIPs again removes the ones added,
+			// so wait for the next tick instead of retrying at once
+			if !r.reconcile() && tick != nil {
+				removed = nil
+			}
+		case <-ctx.Done():
+			if held {
+				release()
+			}
+			return
+		}
+	}
+}
+
+// reconcile sets the VIPs again if any of them is missing. It returns false
+// if they couldn't be checked or set, or had to be set again more than
+// ReaddLimit times.
+func (r *Runner) reconcile() bool {
+	ok, err := r.Manager.HasAll()
+	if err != nil {
+		r.loggerFor(LogReconcile).Warnf("Failed to check IP addresses: %v", err)
+		return false
+	}
+	if ok {
+		return true
+	}
+	r.loggerFor(LogReconcile).Warn("IP address or route missing while leader, setting it again")
+	if _, err := r.Manager.Ensure(); err != nil {
+		r.loggerFor(LogReconcile).Errorf("Failed to set IP addresses: %v", err)
+		r.giveUp()
+		return false
+	}
+	readds.WithLabelValues(r.Manager.Group).Inc()
+	r.mu.Lock()
+	r.readds++
+	r.mu.Unlock()
+	return !r.interfered()
+}
+
+// interfered records a re-add and reports whether there were more than
+// ReaddLimit within ReaddWindow. It logs and counts it when the limit is
+// first exceeded.
+func (r *Runner) interfered() bool {
+	if r.ReaddLimit <= 0 {
+		return false
+	}
+	now := time.Now()
+	recent := r.recentReadds[:0]
+	for _, t := range r.recentReadds {
+		if now.Sub(t) < r.ReaddWindow {
+			recent = append(recent, t)
+		}
+	}
+	r.recentReadds = append(recent, now)
+	if len(r.recentReadds) <= r.ReaddLimit {
+		r.interfering = false
+		return false
+	}
+	if r.interfering {
+		return true
+	}
+	r.interfering = true
+	interference.WithLabelValues(r.Manager.Group).Inc()
+	r.loggerFor(LogReconcile).Errorf("IP addresses set again more than %d times within %v, something keeps removing them",
+		r.ReaddLimit, r.ReaddWindow)
+	if r.ReaddResign {
+		r.giveUp()
+	} else if r.ReconcileInterval > 0 {
+		r.loggerFor(LogReconcile).Warnf("Setting them again only every %v while this lasts", r.ReconcileInterval)
+	}
+	return true
+}
+
+func (r *Runner) release() {
+	if err := r.Manager.Release(); err != nil {
+		r.loggerFor(LogReconcile).Errorf("Failed to release IP addresses: %v", err)
+	}
+	runHook("release", r.OnRelease, r.HookTimeout, r.Manager)
+}
+
+// keeping reports whether the VIPs are left set because Run is returning
+// with KeepOnExit.
+func (r *Runner) keeping() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.keep
+}
+
+// leaderState returns whether the runner leads and a channel that is closed
+// when that changes.
+func (r *Runner) leaderState() (bool, <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.leaderChanged == nil {
+		r.leaderChanged = make(chan struct{})
+	}
+	return r.isLeader, r.leaderChanged
+}
+
+func (r *Runner) setHeld(held bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.held = held
+	if r.heldChanged != nil {
+		close(r.heldChanged)
+		r.heldChanged = nil
+	}
+}
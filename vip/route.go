@@ -0,0 +1,151 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"errors"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// routes returns the routes AddRoute keeps for vaddrs on vlink: one to the
+// network of each VIP that no other address of vlink is in, i.e. that isn't
+// on-link already.
+func (m *Manager) routes(vlink netlink.Link, vaddrs []*netlink.Addr) ([]*netlink.Route, error) {
+	if !m.AddRoute {
+		return nil, nil
+	}
+	addrs, err := m.Netlink.AddrList(vlink, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	var routes []*netlink.Route
+	for _, vaddr := range vaddrs {
+		if m.onLink(vaddr, addrs) {
+			continue
+		}
+		routes = append(routes, &netlink.Route{
+			LinkIndex: vlink.Attrs().Index,
+			Dst:       network(vaddr),
+			Src:       vaddr.IP,
+			Scope:     netlink.SCOPE_LINK,
+			Protocol:  unix.RTPROT_STATIC,
+		})
+	}
+	return routes, nil
+}
+
+// onLink reports whether vaddr is within the subnet of one of addrs other
+// than the VIPs.
+func (m *Manager) onLink(vaddr *netlink.Addr, addrs []netlink.Addr) bool {
+	for _, a := range addrs {
+		if !containsAddr(addrValues(m.Addrs), a) && a.IPNet.Contains(vaddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// missingRoutes returns the routes of the VIPs that vlink has no route to the
+// same network for. The kernel's prefix route of a VIP counts as well.
+func (m *Manager) missingRoutes(vlink netlink.Link) ([]*netlink.Route, error) {
+	routes, err := m.routes(vlink, m.Addrs)
+	if err != nil || len(routes) == 0 {
+		return nil, err
+	}
+	list, err := m.Netlink.RouteList(vlink, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	var missing []*netlink.Route
+	for _, r := range routes {
+		if !containsRoute(list, r) {
+			missing = append(missing, r)
+		}
+	}
+	return missing, nil
+}
+
+// ensureRoutes adds the missing routes of the VIPs to vlink.
+func (m *Manager) ensureRoutes(vlink netlink.Link) error {
+	missing, err := m.missingRoutes(vlink)
+	if err != nil {
+		return err
+	}
+	for _, r := range missing {
+		err := m.retry("add route to "+r.Dst.String(), func() error {
+			return m.Netlink.RouteAdd(r)
+		})
+		if err != nil {
+			return err
+		}
+		m.logger().Infof("Route to %v added on %v", r.Dst, vlink.Attrs().Name)
+	}
+	return nil
+}
+
+// releaseRoutes removes the routes AddRoute added for vaddrs from vlink. The
+// kernel's prefix routes are left to go with their address.
+func (m *Manager) releaseRoutes(vlink netlink.Link, vaddrs []*netlink.Addr) error {
+	if !m.AddRoute {
+		return nil
+	}
+	list, err := m.Netlink.RouteList(vlink, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	var rerr error
+	for _, vaddr := range vaddrs {
+		dst := network(vaddr).String()
+		for _, r := range list {
+			if r.Protocol != unix.RTPROT_STATIC || r.Dst == nil || r.Dst.String() != dst || !r.Src.Equal(vaddr.IP) {
+				continue
+			}
+			route := r
+			err := m.retry("remove route to "+dst, func() error {
+				// Gone with the address already
+				if err := m.Netlink.RouteDel(&route); !errors.Is(err, unix.ESRCH) {
+					return err
+				}
+				return nil
+			})
+			if err != nil {
+				m.logger().Errorf("Failed to remove route to %v: %v", dst, err)
+				if rerr == nil {
+					rerr = err
+				}
+				continue
+			}
+			m.logger().Infof("Route to %v removed from %v", dst, vlink.Attrs().Name)
+		}
+	}
+	return rerr
+}
+
+// network returns the network of vaddr, e.g. 10.0.0.0/24 for 10.0.0.5/24.
+func network(vaddr *netlink.Addr) *net.IPNet {
+	return &net.IPNet{IP: vaddr.IP.Mask(vaddr.Mask), Mask: vaddr.Mask}
+}
+
+func containsRoute(list []netlink.Route, route *netlink.Route) bool {
+	for _, r := range list {
+		if r.Dst != nil && r.Dst.String() == route.Dst.String() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,1031 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const maxBackoff = 30 * time.Second
+
+// Runner campaigns for leadership in an election of its Backend and keeps
+// the VIPs of its Manager set while it is the leader.
+type Runner struct {
+	Backend Backend
+	Manager *Manager
+	// Prefix is the key prefix of the election.
+	Prefix string
+	// Member is the unique name this instance campaigns with.
+	Member string
+	// RequestTimeout bounds requests to the backend made by the runner
+	// itself, like resigning, 5 seconds if zero.
+	RequestTimeout time.Duration
+	// ReconcileInterval is how often to check the VIPs are still set while
+	// leader, zero disables the check.
+	ReconcileInterval time.Duration
+	// ReaddLimit, if set, is how many times the VIPs may have to be set
+	// again within ReaddWindow while leading. Beyond it something is
+	// taken to be fighting over them: it is logged and counted, and
+	// removals are only repaired every ReconcileInterval rather than right
+	// away. ReaddResign steps down instead, so another member can take
+	// over.
+	ReaddLimit  int
+	ReaddWindow time.Duration
+	ReaddResign bool
+	// ARPOnStart sends the gratuitous ARPs when the first leadership of Run
+	// finds the VIPs already set, e.g. left by a crashed run, which are
+	// otherwise kept without announcing them.
+	ARPOnStart bool
+	// ARPRefreshInterval is how often to send gratuitous ARPs again while
+	// leader, zero only sends them after setting the VIPs.
+	ARPRefreshInterval time.Duration
+	// OnAcquire and OnRelease are commands run after the VIPs are set and
+	// released. They are killed after HookTimeout, unless it is zero, so a
+	// hung one doesn't hold up the VIP handling.
+	OnAcquire   string
+	OnRelease   string
+	HookTimeout time.Duration
+	// Priority is campaigned with. The leader hands over to a candidate
+	// with a higher priority once it has been waiting for FailbackDelay.
+	Priority      int
+	FailbackDelay time.Duration
+	// ElectionJitter randomizes retry delays by up to this fraction, e.g.
+	// 0.2 for ±20%, so many members don't hit the backend at the same
+	// time.
+	ElectionJitter float64
+	// Observer only follows the election, it never campaigns or touches
+	// the VIPs.
+	Observer bool
+	// CampaignTimeout abandons and retries a campaign that hasn't won
+	// after this long while there is no other leader to wait for, or the
+	// backend doesn't answer. Zero waits forever.
+	CampaignTimeout time.Duration
+	// MinUptime delays the first campaign until the process has been up
+	// this long, so a freshly started member doesn't take the VIPs before
+	// the services behind them are ready.
+	MinUptime time.Duration
+	// NoPreempt makes the runner campaign only while nobody holds the
+	// leadership instead of waiting in line behind the current leader.
+	NoPreempt bool
+	// FenceTimeout, if set, releases the VIPs while leading once the
+	// backend hasn't confirmed the session for this long, e.g. because
+	// etcd lost quorum, rather than keeping them while the others can't
+	// tell who leads. It needs a session that is a QuorumChecker, as the
+	// etcd and Kubernetes ones are.
+	FenceTimeout time.Duration
+	// SplitBrainInterval, if set, is how often the leader asks the backend
+	// who leads besides following the election, to catch a watch that
+	// missed its replacement. SplitBrainRelease releases the VIPs when the
+	// backend names another member, otherwise it is only logged and
+	// counted.
+	SplitBrainInterval time.Duration
+	SplitBrainRelease  bool
+	// KeepOnExit leaves the VIPs set when Run returns because ctx was
+	// cancelled, the leadership is still resigned. It is meant for
+	// restarting on the same host, which finds them already set.
+	KeepOnExit bool
+	// HandoffTimeout, if set, keeps the VIPs after resigning voluntarily,
+	// that is when asked to, paused or handing over to a higher priority,
+	// until another member is seen leading or for at most this long. The
+	// successor may set them before they are released here.
+	HandoffTimeout time.Duration
+	// Health, if set, must pass before campaigning. The leader steps down
+	// when it fails. The caller runs it, so the Runners of several groups
+	// can share one.
+	Health *HealthCheck
+
+	// ConfigKey, if set, is where the backend keeps a VIPConfig. The
+	// Manager switches to it whenever it changes, keeping the leadership.
+	ConfigKey string
+	// PromoteKey, if set, is where the backend keeps the member an
+	// operator promoted, if the backend is a Promoter. While it names
+	// another member the runner stays out of the election, and as the
+	// leader hands over once that member is waiting in line. The promoted
+	// member doesn't hand over to a higher priority meanwhile.
+	PromoteKey string
+	// DrainKey, if set, is where the backend keeps the drain flag, if the
+	// backend is a Drainer. While it is set the runner stays out of the
+	// election and the leader releases the VIPs and resigns, without
+	// waiting for a successor.
+	DrainKey string
+	// StatusFile, if set, is kept up to date with the leadership state as
+	// JSON and removed on return from Run.
+	StatusFile string
+	// AuditPrefix, if set, is where acquire, release and resign events are
+	// recorded for AuditTTL, if the backend is an Auditor.
+	AuditPrefix string
+	AuditTTL    time.Duration
+	// Notifiers are told when the VIPs are acquired or released, and when
+	// the leader steps down unhealthy or suspects a split brain.
+	Notifiers []Notifier
+	// StallTimeout, if set, is how long the reconcile loop may go without
+	// running, e.g. stuck in netlink or a hook, before the VIPs are
+	// released and OnStall is called, which is expected to exit.
+	StallTimeout time.Duration
+	OnStall      func()
+	// OnChange, if set, is called whenever the runner becomes ready or not,
+	// gains or loses the leadership or sees a new leader.
+	OnChange func()
+
+	mu       sync.Mutex
+	election Election
+	ready    bool
+	expired  bool
+	// connected is set once the first session is created.
+	connected bool
+	leader    Candidate
+	isLeader  bool
+	since     time.Time
+	// held is whether the reconciler holds the VIPs, the changed channels
+	// are closed when isLeader or held change.
+	held          bool
+	hasVIP        bool
+	arpFailing    bool
+	keep          bool
+	leaderChanged chan struct{}
+	heldChanged   chan struct{}
+	// stepDown is closed by Resign while leading, nil otherwise. failed is
+	// set when it was closed because the VIPs couldn't be set.
+	stepDown chan struct{}
+	failed   bool
+
+	// recentReadds are the times of the re-adds within ReaddWindow and
+	// interfering whether there were too many, only used by the reconciler
+	recentReadds []time.Time
+	interfering  bool
+
+	// terms, leaderTime, readds and quorumLosses are kept for Summary
+	terms        int
+	leaderTime   time.Duration
+	readds       int
+	quorumLosses int
+
+	paused       bool
+	pauseChanged chan struct{}
+
+	// lastBeat is when the reconcile loop last ran
+	lastBeat time.Time
+
+	// promoted is the member named under PromoteKey, promoteChanged is
+	// closed when it changes.
+	promoted       string
+	promoteChanged chan struct{}
+
+	// drained is whether the flag under DrainKey is set, changes close
+	// pauseChanged.
+	drained bool
+}
+
+// IsLeader reports whether this runner holds the leadership.
+func (r *Runner) IsLeader() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.isLeader
+}
+
+func (r *Runner) setLeader(leader bool) {
+	r.mu.Lock()
+	if leader && !r.isLeader {
+		r.terms++
+	}
+	if !leader && r.isLeader {
+		r.leaderTime += time.Since(r.since)
+	}
+	r.isLeader = leader
+	r.since = time.Now()
+	r.stepDown = nil
+	r.failed = false
+	if leader {
+		r.stepDown = make(chan struct{})
+	}
+	if r.leaderChanged != nil {
+		close(r.leaderChanged)
+		r.leaderChanged = nil
+	}
+	r.mu.Unlock()
+	recordLeader(r.Manager.Group, leader)
+	r.writeStatus()
+	r.changed()
+}
+
+// HasVIP reports whether all VIPs were set on the interface when they were
+// last checked, which can differ from IsLeader: a leader may have failed to
+// set them, or a member that isn't the leader may still have them.
+func (r *Runner) HasVIP() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.hasVIP
+}
+
+// ARPFailing reports whether none of the gratuitous ARPs of the last round
+// went out, so the VIPs may be set but not announced.
+func (r *Runner) ARPFailing() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.arpFailing
+}
+
+// updateHasVIP takes HasVIP and ARPFailing from the Manager, reporting a
+// change in the status file and to OnChange.
+func (r *Runner) updateHasVIP() {
+	present, failing := r.Manager.Present(), r.Manager.ARPFailing()
+	r.mu.Lock()
+	changed := r.hasVIP != present || r.arpFailing != failing
+	r.hasVIP, r.arpFailing = present, failing
+	r.mu.Unlock()
+	if changed {
+		r.writeStatus()
+		r.changed()
+	}
+}
+
+// LeaderSince returns when the runner last gained or lost the leadership.
+func (r *Runner) LeaderSince() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.since
+}
+
+// Resign steps down from the leadership, releasing the VIPs, and campaigns
+// again. It returns ErrNotLeader unless the runner leads.
+func (r *Runner) Resign() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.isLeader {
+		return ErrNotLeader
+	}
+	select {
+	case <-r.stepDown:
+	default:
+		close(r.stepDown)
+	}
+	return nil
+}
+
+// giveUp steps down from the leadership after failing to set or keep the
+// VIPs, so another member can take over.
+func (r *Runner) giveUp() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.isLeader {
+		return
+	}
+	r.failed = true
+	select {
+	case <-r.stepDown:
+	default:
+		close(r.stepDown)
+	}
+}
+
+// claimFailed reports whether giveUp was called since the leadership was
+// gained.
+func (r *Runner) claimFailed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failed
+}
+
+// Ready reports whether the runner is connected to the backend and taking part in
+// the election.
+func (r *Runner) Ready() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ready
+}
+
+// Healthy reports whether the session is alive. It is false until the first
+// session is created, so a runner still trying to reach the backend doesn't
+// look healthy.
+func (r *Runner) Healthy() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.connected && !r.expired
+}
+
+func (r *Runner) setState(ready, expired bool) {
+	r.mu.Lock()
+	r.ready = ready
+	r.expired = expired
+	r.mu.Unlock()
+	r.changed()
+}
+
+func (r *Runner) changed() {
+	if r.OnChange != nil {
+		r.OnChange()
+	}
+}
+
+// Run takes part in the election until ctx is cancelled. When the session
+// expires it gives up leadership and rejoins with a new session. On
+// return it has resigned leadership if it held it. It returns nil once ctx
+// is cancelled, or an error wrapping ErrUnauthorized if the backend rejects
+// it for good.
+func (r *Runner) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer r.setState(false, false)
+	initMetrics(r.Manager.Group)
+	if r.StatusFile != "" {
+		r.writeStatus()
+		defer os.Remove(r.StatusFile)
+	}
+	if r.Health != nil {
+		go r.followHealth(ctx)
+	}
+	if r.ConfigKey != "" && !r.Observer {
+		go r.watchConfig(ctx)
+	}
+	if r.PromoteKey != "" && !r.Observer {
+		go r.followPromotion(ctx)
+	}
+	if r.DrainKey != "" && !r.Observer {
+		go r.followDrain(ctx)
+	}
+	if r.Manager.BackupInterface != "" && !r.Observer {
+		go r.Manager.followCarrier(ctx)
+	}
+	if !r.Observer {
+		// The reconciler outlives the election so it can release the
+		// VIPs after ctx is cancelled
+		rctx, rcancel := context.WithCancel(context.Background())
+		rdone := make(chan struct{})
+		go func() {
+			defer close(rdone)
+			r.reconcileLoop(rctx)
+		}()
+		if r.StallTimeout > 0 {
+			r.beat()
+			go r.watchStall(ctx)
+		}
+		defer func() {
+			rcancel()
+			<-rdone
+		}()
+	}
+
+	first := true
+	for attempt := 0; ctx.Err() == nil; {
+		s, err := r.Backend.NewSession(ctx)
+		if errors.Is(err, ErrUnauthorized) {
+			return err
+		}
+		if err != nil {
+			r.logger().Warnf("Failed to create %v session: %v", r.Backend, err)
+			if !sleep(ctx, r.backoff(attempt)) {
+				return nil
+			}
+			attempt++
+			continue
+		}
+		attempt = 0
+		r.mu.Lock()
+		r.connected = true
+		r.mu.Unlock()
+		if !first {
+			r.logger().Infof("Rejoining the election with a new %v session", r.Backend)
+		}
+		r.elect(ctx, s, first)
+		s.Close()
+		first = false
+	}
+	return nil
+}
+
+// elect takes part in the election with the session s until ctx is cancelled
+// or s expires. It only decides whether this runner leads, the reconciler
+// sets and releases the VIPs accordingly. On return the VIPs are released and
+// leadership is resigned if the session is still alive. Stale VIPs are only
+// released on the first session, later ones start from the state elect left
+// behind.
+func (r *Runner) elect(ctx context.Context, s Session, first bool) {
+	ectx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.Done():
+			r.logger().Warnf("%v session expired", r.Backend)
+			r.setState(false, true)
+			cancel()
+		case <-ectx.Done():
+		}
+	}()
+
+	e := s.Election(r.Prefix)
+	r.mu.Lock()
+	r.election = e
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.election = nil
+		r.mu.Unlock()
+		if !r.IsLeader() {
+			return
+		}
+		if r.KeepOnExit && ctx.Err() != nil {
+			r.mu.Lock()
+			r.keep = true
+			r.mu.Unlock()
+		}
+		r.demote()
+		select {
+		case <-s.Done():
+		default:
+			r.resign(e)
+		}
+	}()
+
+	if r.Observer {
+		go r.observe(ectx, e)
+		r.setState(true, false)
+		<-ectx.Done()
+		return
+	}
+	if first {
+		if set, _, err := r.Manager.Has(); err == nil && anySet(set) {
+			go r.releaseStale(ectx, e)
+		}
+	}
+	go r.observe(ectx, e)
+
+	r.setState(true, false)
+	if wait := time.Until(processStart.Add(r.MinUptime)); wait > 0 {
+		r.logger().Infof("Waiting %v for the minimum uptime before campaigning", wait.Round(time.Second))
+		if !sleep(ectx, wait) {
+			return
+		}
+	}
+	attempt, failures := 0, 0
+	for ectx.Err() == nil {
+		if !r.waitEligible(ectx) {
+			return
+		}
+		r.logger().Debug("Waiting to become the leader")
+		cctx, ccancel := r.eligibleContext(ectx)
+		if r.NoPreempt && !r.waitNoLeader(cctx, e) {
+			ccancel()
+			continue
+		}
+		err := r.campaign(cctx, e)
+		ccancel()
+		if ectx.Err() != nil {
+			return
+		}
+		if err == context.Canceled {
+			// The health check failed or we were paused while
+			// campaigning
+			continue
+		}
+		if err != nil {
+			r.logger().Warnf("Campaign failed: %v", err)
+			if !sleep(ectx, r.backoff(attempt)) {
+				return
+			}
+			attempt++
+			continue
+		}
+		r.logger().Debug("I am the leader")
+		if !r.promotedHere() && r.higherWaiting(ectx, e) {
+			// Nobody holds the VIPs during a failover, so a
+			// preferred member waiting in line gets them right away
+			r.logger().Info("Passing the leadership on to a member with a higher priority")
+			r.resign(e)
+			continue
+		}
+		attempt = 0
+		r.setLeader(true)
+
+		hctx, hcancel := r.eligibleContext(ectx)
+		quorumLost := r.watchQuorum(hctx, s)
+		handover := r.hold(hctx, e, quorumLost, r.watchLeader(hctx, e))
+		hcancel()
+		failed := r.claimFailed()
+		// Nobody takes over from a drained leader, so it doesn't wait
+		if (handover || r.Paused() && ectx.Err() == nil) && !failed && !r.Drained() && r.HandoffTimeout > 0 {
+			r.handoff(ectx, e)
+			continue
+		}
+		// Leadership is lost, the session expired, we are unhealthy, paused,
+		// drained or shutting down. The VIPs go before resigning so the next leader
+		// never finds them still set here.
+		r.demote()
+		if ectx.Err() == nil && r.Health != nil {
+			if healthy, _ := r.Health.Healthy(); !healthy {
+				r.notify(EventUnhealthy)
+			}
+		}
+		if hctx.Err() != nil || handover {
+			select {
+			case <-s.Done():
+			default:
+				r.resign(e)
+			}
+		}
+		select {
+		case <-quorumLost:
+			// The election still has this member leading, campaigning
+			// would win it right back
+			if !r.waitQuorum(ectx, s) {
+				return
+			}
+		default:
+		}
+		if !failed {
+			failures = 0
+			continue
+		}
+		// Leave the others time to take over before campaigning again
+		if !sleep(ectx, r.backoff(failures)) {
+			return
+		}
+		failures++
+	}
+}
+
+// campaign runs e.Campaign, giving up after CampaignTimeout unless the time
+// was spent waiting in line behind a live leader.
+func (r *Runner) campaign(ctx context.Context, e Election) error {
+	campaigns.WithLabelValues(r.Manager.Group).Inc()
+	if r.CampaignTimeout <= 0 {
+		return e.Campaign(ctx, r.candidate().String())
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timedOut := make(chan struct{})
+	go func() {
+		t := time.NewTicker(r.CampaignTimeout)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-cctx.Done():
+				return
+			}
+			lctx, lcancel := context.WithTimeout(cctx, r.requestTimeout())
+			leader, err := e.Leader(lctx)
+			lcancel()
+			if err == nil && ParseCandidate(leader).Member != r.Member {
+				continue
+			}
+			if cctx.Err() == nil {
+				close(timedOut)
+				cancel()
+			}
+			return
+		}
+	}()
+	err := e.Campaign(cctx, r.candidate().String())
+	if err == nil {
+		return nil
+	}
+	select {
+	case <-timedOut:
+		campaignTimeouts.WithLabelValues(r.Manager.Group).Inc()
+		return fmt.Errorf("no leader elected within %v", r.CampaignTimeout)
+	default:
+		return err
+	}
+}
+
+// demote gives up the leadership and waits for the reconciler to release
+// the VIPs.
+func (r *Runner) demote() {
+	r.setLeader(false)
+	for {
+		r.mu.Lock()
+		held := r.held
+		if r.heldChanged == nil {
+			r.heldChanged = make(chan struct{})
+		}
+		changed := r.heldChanged
+		r.mu.Unlock()
+		if !held {
+			return
+		}
+		<-changed
+	}
+}
+
+// followHealth reports health changes in the status file and to OnChange
+// until ctx is cancelled.
+func (r *Runner) followHealth(ctx context.Context) {
+	for {
+		_, changed := r.Health.Healthy()
+		select {
+		case <-changed:
+			r.writeStatus()
+			r.changed()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// writeStatus replaces the status file with the current state.
+func (r *Runner) writeStatus() {
+	if r.StatusFile == "" {
+		return
+	}
+	healthy := true
+	if r.Health != nil {
+		healthy, _ = r.Health.Healthy()
+	}
+	r.mu.Lock()
+	status := struct {
+		Leader         bool      `json:"leader"`
+		VIP            string    `json:"vip"`
+		Since          time.Time `json:"since"`
+		Priority       int       `json:"priority"`
+		CurrentLeader  string    `json:"current_leader,omitempty"`
+		LeaderPriority int       `json:"leader_priority"`
+		Healthy        bool      `json:"healthy"`
+		HasVIP         bool      `json:"has_vip"`
+		ARPFailing     bool      `json:"arp_failing,omitempty"`
+	}{r.isLeader, r.Manager.String(), r.since, r.Priority, r.leader.Member, r.leader.Priority, healthy, r.hasVIP, r.arpFailing}
+	r.mu.Unlock()
+	if status.Since.IsZero() {
+		status.Since = time.Now()
+	}
+	b, err := json.Marshal(status)
+	if err == nil {
+		err = writeFileAtomic(r.StatusFile, append(b, '\n'))
+	}
+	if err != nil {
+		r.logger().Warnf("Failed to write status file: %v", err)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// over path, so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Pause resigns the leadership if held and stops campaigning until Resume is
+// called.
+func (r *Runner) Pause() {
+	r.setPaused(true)
+}
+
+// Resume undoes Pause.
+func (r *Runner) Resume() {
+	r.setPaused(false)
+}
+
+// Paused reports whether the runner is paused.
+func (r *Runner) Paused() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.paused
+}
+
+func (r *Runner) setPaused(paused bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.paused == paused {
+		return
+	}
+	r.paused = paused
+	if paused {
+		r.logger().Info("Paused, not taking part in the election")
+	} else {
+		r.logger().Info("Resumed, taking part in the election")
+	}
+	if r.pauseChanged != nil {
+		close(r.pauseChanged)
+		r.pauseChanged = nil
+	}
+}
+
+// eligible reports whether the runner may lead, that is it is healthy, not
+// paused or drained and, unless it leads already, not standing aside for a promoted
+// member. It returns channels that are closed when either changes.
+func (r *Runner) eligible() (bool, <-chan struct{}, <-chan struct{}) {
+	healthy := true
+	var healthChanged <-chan struct{}
+	if r.Health != nil {
+		healthy, healthChanged = r.Health.Healthy()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pauseChanged == nil {
+		r.pauseChanged = make(chan struct{})
+	}
+	aside := r.promoted != "" && r.promoted != r.Member && !r.isLeader
+	return healthy && !r.paused && !r.drained && !aside, healthChanged, r.pauseChanged
+}
+
+// waitEligible blocks until the runner may lead, returning false if ctx is
+// cancelled first.
+func (r *Runner) waitEligible(ctx context.Context) bool {
+	for {
+		ok, healthChanged, pauseChanged := r.eligible()
+		if ok {
+			return true
+		}
+		select {
+		case <-healthChanged:
+		case <-pauseChanged:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// eligibleContext returns a context that is also cancelled when the runner
+// is no longer eligible to lead.
+func (r *Runner) eligibleContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		for {
+			ok, healthChanged, pauseChanged := r.eligible()
+			if !ok {
+				cancel()
+				return
+			}
+			select {
+			case <-healthChanged:
+			case <-pauseChanged:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ctx, cancel
+}
+
+func (r *Runner) requestTimeout() time.Duration {
+	if r.RequestTimeout > 0 {
+		return r.RequestTimeout
+	}
+	return 5 * time.Second
+}
+
+// resign gives up the leadership of e, reporting whether it succeeded.
+func (r *Runner) resign(e Election) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), r.requestTimeout())
+	defer cancel()
+	if err := e.Resign(ctx); err != nil {
+		r.logger().Warnf("Failed to resign leadership: %v", err)
+		return false
+	}
+	r.logger().Info("Resigned leadership")
+	r.audit("resign")
+	return true
+}
+
+// handoff resigns the leadership of e but keeps the VIPs until another
+// member is seen leading, for at most HandoffTimeout or until ctx is
+// cancelled, then releases them.
+func (r *Runner) handoff(ctx context.Context, e Election) {
+	defer r.demote()
+	if !r.resign(e) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.HandoffTimeout)
+	defer cancel()
+	for value := range e.Observe(ctx) {
+		if value == "" {
+			continue
+		}
+		if leader := ParseCandidate(value).Member; leader != r.Member {
+			r.logger().Infof("%s is the leader now, releasing IP addresses", leader)
+			return
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		r.logger().Warnf("No other leader within %v, releasing IP addresses", r.HandoffTimeout)
+	}
+}
+
+// observe keeps track of the current leader until ctx is cancelled.
+func (r *Runner) observe(ctx context.Context, e Election) {
+	for value := range e.Observe(ctx) {
+		if value == "" {
+			continue
+		}
+		leader := ParseCandidate(value)
+		r.mu.Lock()
+		changed := r.leader != leader
+		r.leader = leader
+		r.mu.Unlock()
+		if changed && leader.Member == r.Member && leader.PID != 0 && !r.self(leader) {
+			r.logger().Errorf("Another govip, pid %d started at %v, leads as member %v. Members must be unique, "+
+				"unless this is the lease of a previous run on this host which expires shortly",
+				leader.PID, leader.Started.Format(time.RFC3339), leader.Member)
+		}
+		if changed {
+			r.logger().Infof("%v is the leader with priority %d", leader.Member, leader.Priority)
+			r.writeStatus()
+			r.changed()
+		}
+	}
+}
+
+// Leader returns the member name of the current leader, or an empty string if
+// none has been seen yet.
+func (r *Runner) Leader() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leader.Member
+}
+
+// waitNoLeader blocks until nobody but this member holds the leadership or
+// this member is promoted. It returns false if ctx was cancelled first.
+func (r *Runner) waitNoLeader(ctx context.Context, e Election) bool {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	leaders := e.Observe(ctx)
+	for {
+		// A promoted member joins the line so the leader can hand over
+		member, changed := r.promotion()
+		if member == r.Member {
+			return true
+		}
+		select {
+		case value, ok := <-leaders:
+			if !ok {
+				return false
+			}
+			leader := ParseCandidate(value)
+			if value == "" || leader.Member == r.Member {
+				return true
+			}
+			r.logger().Debugf("Not preempting %s, waiting for it to step down", leader.Member)
+		case <-changed:
+		}
+	}
+}
+
+// QueryLeader asks the backend for the member name of the current leader. It returns
+// ErrNoLeader if there is none.
+func (r *Runner) QueryLeader(ctx context.Context) (string, error) {
+	r.mu.Lock()
+	e := r.election
+	r.mu.Unlock()
+	if e == nil {
+		return "", errors.New("not connected to the backend")
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.requestTimeout())
+	defer cancel()
+	value, err := e.Leader(ctx)
+	if err != nil {
+		return "", err
+	}
+	return ParseCandidate(value).Member, nil
+}
+
+// logger returns the logger of the election component with the fields of the
+// runner, loggerFor that of another component.
+func (r *Runner) logger() *log.Entry {
+	return r.loggerFor(LogElection)
+}
+
+func (r *Runner) loggerFor(component string) *log.Entry {
+	return r.Manager.componentLogger(component).WithField("member", r.Member)
+}
+
+// releaseStale removes VIPs left over from a previous run once another
+// member is seen leading. If this member is the first leader seen they are
+// kept, so restarting the leader doesn't drop its VIPs.
+func (r *Runner) releaseStale(ctx context.Context, e Election) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for value := range e.Observe(ctx) {
+		if value == "" {
+			continue
+		}
+		if leader := ParseCandidate(value).Member; leader != r.Member {
+			r.logger().Infof("%v is the leader, releasing IP addresses left from a previous run", leader)
+			if err := r.Manager.Release(); err != nil {
+				r.logger().Errorf("Failed to release IP addresses: %v", err)
+			}
+		}
+		return
+	}
+}
+
+// hold returns once another member is seen leading, quorumLost or
+// splitBrain is closed or ctx is cancelled. It returns true if the
+// leadership should be handed over to a member with a higher priority.
+func (r *Runner) hold(ctx context.Context, e Election, quorumLost, splitBrain <-chan struct{}) bool {
+	octx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	leaders := e.Observe(octx)
+	failback := r.failback(octx, e)
+	promote := r.promote(octx, e)
+	r.mu.Lock()
+	stepDown := r.stepDown
+	r.mu.Unlock()
+	for {
+		select {
+		case value, ok := <-leaders:
+			if !ok {
+				leaders = nil
+				continue
+			}
+			if value == "" {
+				r.logger().Warn("Leadership lost")
+				return false
+			}
+			if leader := ParseCandidate(value).Member; leader != r.Member {
+				r.logger().Warnf("%s is the leader now, leadership lost", leader)
+				return false
+			}
+		case c := <-failback:
+			r.logger().Infof("Handing the leadership over to %s with priority %d", c.Member, c.Priority)
+			return true
+		case c := <-promote:
+			r.logger().Infof("Handing the leadership over to %s as promoted", c.Member)
+			return true
+		case <-stepDown:
+			if r.claimFailed() {
+				r.logger().Warn("Stepping down, the IP addresses couldn't be kept set")
+			} else {
+				r.logger().Info("Stepping down as asked")
+			}
+			return true
+		case <-quorumLost:
+			return false
+		case <-splitBrain:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// backoff returns the exponential delay before retry number attempt, capped
+// at maxBackoff.
+func backoff(attempt int) time.Duration {
+	if attempt >= 5 {
+		return maxBackoff
+	}
+	d := time.Second << uint(attempt)
+	if d > maxBackoff {
+		return maxBackoff
+	}
+	return d
+}
+
+// backoff returns backoff(attempt) with ElectionJitter applied.
+func (r *Runner) backoff(attempt int) time.Duration {
+	return jitter(backoff(attempt), r.ElectionJitter)
+}
+
+// jitter returns d changed randomly by up to the fraction j of it.
+func jitter(d time.Duration, j float64) time.Duration {
+	if j <= 0 {
+		return d
+	}
+	return d + time.Duration(float64(d)*j*(2*rand.Float64()-1))
+}
+
+// sleep waits for d, returning false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
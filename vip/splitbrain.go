@@ -0,0 +1,73 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"context"
+	"time"
+)
+
+// watchLeader asks e for the leader every SplitBrainInterval while leading,
+// until ctx is cancelled. hold follows the leader through Observe, which
+// keeps quiet when the watch stalls, so a leader that was replaced can hold
+// the VIPs together with its successor. When the backend names another
+// member while the VIPs are set here, a split brain is suspected: it is
+// logged and counted, and with SplitBrainRelease the returned channel is
+// closed. It is never closed otherwise.
+func (r *Runner) watchLeader(ctx context.Context, e Election) <-chan struct{} {
+	suspect := make(chan struct{})
+	if r.SplitBrainInterval <= 0 {
+		return suspect
+	}
+	go func() {
+		t := time.NewTicker(r.SplitBrainInterval)
+		defer t.Stop()
+		suspected := false
+		for {
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+			lctx, cancel := context.WithTimeout(ctx, r.requestTimeout())
+			value, err := e.Leader(lctx)
+			cancel()
+			if err != nil {
+				// Losing the backend is for the session and
+				// FenceTimeout to handle
+				r.logger().Debugf("Failed to check the leader: %v", err)
+				continue
+			}
+			leader := ParseCandidate(value).Member
+			if leader == r.Member || !r.Manager.Present() {
+				suspected = false
+				continue
+			}
+			r.logger().Errorf("%v reports %s as the leader while this member holds %v, split brain suspected",
+				r.Backend, leader, r.Manager)
+			if !suspected {
+				splitBrains.WithLabelValues(r.Manager.Group).Inc()
+				r.notify(EventSplitBrain)
+				suspected = true
+			}
+			if r.SplitBrainRelease {
+				r.logger().Warn("Releasing IP addresses to fail safe")
+				close(suspect)
+				return
+			}
+		}
+	}()
+	return suspect
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"context"
+	"time"
+)
+
+// beat records that the reconcile loop is alive, for watchStall.
+func (r *Runner) beat() {
+	r.mu.Lock()
+	r.lastBeat = time.Now()
+	r.mu.Unlock()
+}
+
+// watchStall checks every quarter of StallTimeout that the reconcile loop
+// has run within StallTimeout, until ctx is cancelled. When it hasn't, e.g.
+// because netlink hangs, the VIPs are in an unknown state while the
+// leadership is kept: it releases them if that doesn't hang as well and
+// calls OnStall.
+func (r *Runner) watchStall(ctx context.Context) {
+	t := time.NewTicker(r.StallTimeout / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		r.mu.Lock()
+		stalled := time.Since(r.lastBeat)
+		r.mu.Unlock()
+		if stalled < r.StallTimeout {
+			continue
+		}
+		r.loggerFor(LogReconcile).Errorf("The reconcile loop hasn't run for %v, releasing IP addresses and giving up", stalled.Round(time.Second))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if err := r.Manager.Release(); err != nil {
+				r.loggerFor(LogReconcile).Errorf("Failed to release IP addresses: %v", err)
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(r.requestTimeout()):
+			r.loggerFor(LogReconcile).Error("Releasing IP addresses is stuck as well")
+		}
+		if r.OnStall != nil {
+			r.OnStall()
+		}
+		return
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Summary is what a Runner did during Run, for a log line on exit.
+type Summary struct {
+	// Leader is whether the runner leads now.
+	Leader bool
+	// Terms is the number of times it became the leader and LeaderTime
+	// the time it spent leading, including the current term.
+	Terms      int
+	LeaderTime time.Duration
+	// Readds is the number of times a VIP was found missing while leading
+	// and set again.
+	Readds int
+	// ARPBursts is the number of rounds of gratuitous ARPs started.
+	ARPBursts int
+	// QuorumLosses is the number of times the VIPs were released because
+	// the backend didn't confirm the session for FenceTimeout.
+	QuorumLosses int
+}
+
+// Summary returns the counters of the runner so far.
+func (r *Runner) Summary() Summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := Summary{
+		Leader:       r.isLeader,
+		Terms:        r.terms,
+		LeaderTime:   r.leaderTime,
+		Readds:       r.readds,
+		ARPBursts:    int(atomic.LoadInt64(&r.Manager.bursts)),
+		QuorumLosses: r.quorumLosses,
+	}
+	if r.isLeader {
+		s.LeaderTime += time.Since(r.since)
+	}
+	return s
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// sysctlDir is where the per-interface IPv4 sysctls are kept.
+const sysctlDir = "/proc/sys/net/ipv4/conf"
+
+// setARPBehavior applies ARPIgnore, ARPAnnounce and NoARP, vlink being
+// Interface. Settings already in place are left alone.
+func (m *Manager) setARPBehavior(vlink netlink.Link) error {
+	if m.NoARP && vlink.Attrs().RawFlags&unix.IFF_NOARP == 0 {
+		if err := m.Netlink.LinkSetARPOff(vlink); err != nil {
+			return err
+		}
+		m.arpLogger().Infof("Set NOARP on %v", vlink.Attrs().Name)
+	}
+	for _, iface := range m.arpInterfaces() {
+		for _, s := range []struct {
+			name  string
+			value int
+		}{
+			{"arp_ignore", m.ARPIgnore},
+			{"arp_announce", m.ARPAnnounce},
+		} {
+			if s.value < 0 {
+				continue
+			}
+			// /proc/sys/net shows the namespace of the thread
+			err := m.inNamespace(func() error { return m.setSysctl(iface, s.name, strconv.Itoa(s.value)) })
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setSysctl writes value to the named IPv4 sysctl of iface unless it is
+// already set to it.
+func (m *Manager) setSysctl(iface, name, value string) error {
+	path := filepath.Join(sysctlDir, iface, name)
+	old, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if string(bytes.TrimSpace(old)) == value {
+		return nil
+	}
+	if m.DryRun {
+		m.arpLogger().Infof("Dry run: would set %v to %v", path, value)
+		return nil
+	}
+	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+		return err
+	}
+	m.arpLogger().Infof("Set %v to %v", path, value)
+	return nil
+}
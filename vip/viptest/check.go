@@ -0,0 +1,141 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package viptest
+
+import (
+	"fmt"
+
+	"github.com/retinadata/govip/vip"
+	"github.com/vishvananda/netlink"
+)
+
+// CheckManager runs a Manager against the kernel in a new Namespace and
+// returns an error describing the first step where it disagrees with the
+// addresses actually set, or ErrNotRoot. It is meant for integration tests
+// that skip on ErrNotRoot, the NetLinker fake covers the logic without root.
+func CheckManager() error {
+	ns, err := NewNamespace("govip0", "govip1")
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	vips := []string{"10.254.0.1/32", "fd00:254::1/128"}
+	m, err := vip.NewManagerWith(ns, vips, ns.Link)
+	if err != nil {
+		return err
+	}
+	// The Namespace is a vip.Doer, so the ARPs go out of Link
+	m.ARPCount = 1
+	m.ARPInterval = 0
+
+	// expect checks both the Manager and the kernel see the VIPs set or not
+	expect := func(step string, want bool) error {
+		all, err := m.HasAll()
+		if err != nil {
+			return fmt.Errorf("%v: %v", step, err)
+		}
+		set, _, err := m.Has()
+		if err != nil {
+			return fmt.Errorf("%v: %v", step, err)
+		}
+		if all != want {
+			return fmt.Errorf("%v: HasAll is %v, want %v", step, all, want)
+		}
+		onLink, err := ns.has(vips)
+		if err != nil {
+			return fmt.Errorf("%v: %v", step, err)
+		}
+		for i, v := range vips {
+			if set[i] != want || onLink[i] != want {
+				return fmt.Errorf("%v: %v is set %v, the kernel says %v, want %v", step, v, set[i], onLink[i], want)
+			}
+		}
+		return nil
+	}
+
+	if err := expect("before Ensure", false); err != nil {
+		return err
+	}
+	if added, err := m.Ensure(); err != nil || !added {
+		return fmt.Errorf("Ensure: added %v, %v", added, err)
+	}
+	if err := expect("after Ensure", true); err != nil {
+		return err
+	}
+	if added, err := m.Ensure(); err != nil || added {
+		return fmt.Errorf("Ensure again: added %v, %v", added, err)
+	}
+	if err := m.Release(); err != nil {
+		return fmt.Errorf("Release: %v", err)
+	}
+	if err := expect("after Release", false); err != nil {
+		return err
+	}
+
+	// Changes made behind the Manager's back
+	link, err := ns.LinkByName(ns.Link)
+	if err != nil {
+		return err
+	}
+	for _, v := range vips {
+		a, err := netlink.ParseAddr(v)
+		if err == nil {
+			err = ns.AddrAdd(link, a)
+		}
+		if err != nil {
+			return fmt.Errorf("adding %v: %v", v, err)
+		}
+	}
+	if err := expect("after adding them outside", true); err != nil {
+		return err
+	}
+	a, _ := netlink.ParseAddr(vips[0])
+	if err := ns.AddrDel(link, a); err != nil {
+		return fmt.Errorf("removing %v: %v", vips[0], err)
+	}
+	if all, err := m.HasAll(); err != nil || all {
+		return fmt.Errorf("after removing %v outside: HasAll is %v, %v", vips[0], all, err)
+	}
+	if err := m.Release(); err != nil {
+		return fmt.Errorf("Release: %v", err)
+	}
+	return expect("after the last Release", false)
+}
+
+// has reports for each address in CIDR notation whether it is set on Link.
+func (n *Namespace) has(addrs []string) ([]bool, error) {
+	link, err := n.LinkByName(n.Link)
+	if err != nil {
+		return nil, err
+	}
+	list, err := n.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	set := make([]bool, len(addrs))
+	for i, s := range addrs {
+		a, err := netlink.ParseAddr(s)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range list {
+			if l.IPNet.String() == a.IPNet.String() {
+				set[i] = true
+			}
+		}
+	}
+	return set, nil
+}
@@ -0,0 +1,319 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package viptest provides an in-memory vip.NetLinker for tests.
+package viptest
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// NetLinker keeps addresses in memory per link name. Failures can be
+// injected with AddErr and DelErr.
+type NetLinker struct {
+	mu       sync.Mutex
+	links    map[string][]netlink.Addr
+	down     map[string]bool
+	noARP    map[string]bool
+	index    map[string]int
+	macs     map[string]net.HardwareAddr
+	disabled map[string]bool
+	routes   []netlink.Route
+	subs     []chan netlink.AddrUpdate
+	linkSubs []chan netlink.LinkUpdate
+
+	// AddErr, if set, is called before each AddrAdd and a non-nil result
+	// is returned instead of adding the address.
+	AddErr func(addr *netlink.Addr) error
+	// DelErr is the AddrDel counterpart of AddErr.
+	DelErr func(addr *netlink.Addr) error
+}
+
+// NewNetLinker returns a NetLinker with the named links and no addresses.
+// The links have a carrier until SetCarrier is called.
+func NewNetLinker(links ...string) *NetLinker {
+	n := &NetLinker{
+		links:    map[string][]netlink.Addr{},
+		down:     map[string]bool{},
+		noARP:    map[string]bool{},
+		index:    map[string]int{},
+		macs:     map[string]net.HardwareAddr{},
+		disabled: map[string]bool{},
+	}
+	for _, l := range links {
+		n.links[l] = nil
+		n.index[l] = len(n.index) + 1
+	}
+	return n
+}
+
+func (n *NetLinker) ParseAddr(s string) (*netlink.Addr, error) {
+	return netlink.ParseAddr(s)
+}
+
+func (n *NetLinker) LinkByName(name string) (netlink.Link, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.links[name]; !ok {
+		// Like netlink, which wraps the ENODEV of the kernel
+		return nil, fmt.Errorf("Link %s not found: %w", name, unix.ENODEV)
+	}
+	return n.link(name), nil
+}
+
+// link returns the named link with its carrier and NOARP flags. It is called
+// with mu held.
+func (n *NetLinker) link(name string) netlink.Link {
+	attrs := netlink.LinkAttrs{Name: name, Index: n.index[name], HardwareAddr: n.macs[name]}
+	if !n.disabled[name] {
+		attrs.Flags = net.FlagUp
+		attrs.RawFlags = unix.IFF_UP
+	}
+	if !n.down[name] {
+		attrs.RawFlags |= unix.IFF_LOWER_UP
+	}
+	if n.noARP[name] {
+		attrs.RawFlags |= unix.IFF_NOARP
+	}
+	return &netlink.Dummy{LinkAttrs: attrs}
+}
+
+// SetCarrier sets whether the named link has a carrier and tells the
+// LinkSubscribe subscribers.
+func (n *NetLinker) SetCarrier(name string, up bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[name] = !up
+	u := netlink.LinkUpdate{Link: n.link(name)}
+	for _, q := range n.linkSubs {
+		select {
+		case q <- u:
+		default:
+		}
+	}
+}
+
+func (n *NetLinker) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	addrs := n.links[link.Attrs().Name]
+	return append([]netlink.Addr(nil), addrs...), nil
+}
+
+func (n *NetLinker) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	if n.AddErr != nil {
+		if err := n.AddErr(addr); err != nil {
+			return err
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	name := link.Attrs().Name
+	for _, a := range n.links[name] {
+		if a.Equal(*addr) {
+			return fmt.Errorf("file exists")
+		}
+	}
+	n.links[name] = append(n.links[name], *addr)
+	n.notify(*addr, true)
+	return nil
+}
+
+func (n *NetLinker) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	if n.DelErr != nil {
+		if err := n.DelErr(addr); err != nil {
+			return err
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	name := link.Attrs().Name
+	for i, a := range n.links[name] {
+		if a.Equal(*addr) {
+			n.links[name] = append(n.links[name][:i], n.links[name][i+1:]...)
+			n.notify(a, false)
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot assign requested address")
+}
+
+func (n *NetLinker) LinkAdd(link netlink.Link) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	name := link.Attrs().Name
+	if _, ok := n.links[name]; ok {
+		return unix.EEXIST
+	}
+	n.links[name] = nil
+	n.index[name] = len(n.index) + 1
+	n.macs[name] = link.Attrs().HardwareAddr
+	return nil
+}
+
+func (n *NetLinker) LinkSetUp(link netlink.Link) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.disabled, link.Attrs().Name)
+	return nil
+}
+
+func (n *NetLinker) LinkSetDown(link netlink.Link) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.disabled[link.Attrs().Name] = true
+	return nil
+}
+
+func (n *NetLinker) LinkSetARPOff(link netlink.Link) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.noARP[link.Attrs().Name] = true
+	return nil
+}
+
+// RouteList returns the routes added to link through n.
+func (n *NetLinker) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var list []netlink.Route
+	for _, r := range n.routes {
+		if r.LinkIndex == link.Attrs().Index {
+			list = append(list, r)
+		}
+	}
+	return list, nil
+}
+
+func (n *NetLinker) RouteAdd(route *netlink.Route) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, r := range n.routes {
+		if r.Equal(*route) {
+			return unix.EEXIST
+		}
+	}
+	n.routes = append(n.routes, *route)
+	return nil
+}
+
+func (n *NetLinker) RouteDel(route *netlink.Route) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i, r := range n.routes {
+		if r.Equal(*route) {
+			n.routes = append(n.routes[:i], n.routes[i+1:]...)
+			return nil
+		}
+	}
+	return unix.ESRCH
+}
+
+// AddrSubscribe sends the addresses added and removed through n to ch until
+// done is closed.
+func (n *NetLinker) AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}) error {
+	queue := make(chan netlink.AddrUpdate, 64)
+	n.mu.Lock()
+	n.subs = append(n.subs, queue)
+	n.mu.Unlock()
+	go func() {
+		defer close(ch)
+		defer n.unsubscribe(queue)
+		for {
+			select {
+			case u := <-queue:
+				select {
+				case ch <- u:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// LinkSubscribe sends the carrier changes made with SetCarrier to ch until
+// done is closed.
+func (n *NetLinker) LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error {
+	queue := make(chan netlink.LinkUpdate, 64)
+	n.mu.Lock()
+	n.linkSubs = append(n.linkSubs, queue)
+	n.mu.Unlock()
+	go func() {
+		defer close(ch)
+		defer n.unsubscribeLinks(queue)
+		for {
+			select {
+			case u := <-queue:
+				select {
+				case ch <- u:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (n *NetLinker) unsubscribeLinks(queue chan netlink.LinkUpdate) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i, q := range n.linkSubs {
+		if q == queue {
+			n.linkSubs = append(n.linkSubs[:i], n.linkSubs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (n *NetLinker) unsubscribe(queue chan netlink.AddrUpdate) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i, q := range n.subs {
+		if q == queue {
+			n.subs = append(n.subs[:i], n.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// notify queues an update for the subscribers, dropping it for those that
+// are too far behind. It is called with mu held.
+func (n *NetLinker) notify(addr netlink.Addr, added bool) {
+	u := netlink.AddrUpdate{LinkAddress: *addr.IPNet, NewAddr: added}
+	for _, q := range n.subs {
+		select {
+		case q <- u:
+		default:
+		}
+	}
+}
+
+// Addrs returns the addresses currently on the named link.
+func (n *NetLinker) Addrs(name string) []netlink.Addr {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]netlink.Addr(nil), n.links[name]...)
+}
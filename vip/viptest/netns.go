@@ -0,0 +1,170 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package viptest
+
+import (
+	"errors"
+	"os"
+	"runtime"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// ErrNotRoot is returned by NewNamespace when the process can't create
+// network namespaces, e.g. without CAP_NET_ADMIN, tests should skip rather
+// than fail on it.
+var ErrNotRoot = errors.New("network namespaces need root")
+
+// Namespace is a network namespace with a veth pair, Link and Peer, both up.
+// It is a vip.NetLinker making real netlink calls in the namespace, so a
+// Manager can be exercised against the kernel without touching the host's
+// interfaces.
+type Namespace struct {
+	// Link and Peer are the names of the ends of the veth pair.
+	Link, Peer string
+
+	ns     netns.NsHandle
+	handle *netlink.Handle
+}
+
+// NewNamespace creates an unnamed network namespace with a veth pair named
+// link and peer. Close removes it.
+func NewNamespace(link, peer string) (*Namespace, error) {
+	if os.Geteuid() != 0 {
+		return nil, ErrNotRoot
+	}
+	// netns.New switches the calling thread, which must be switched back
+	// before other goroutines get to run on it
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer orig.Close()
+	ns, err := netns.New()
+	if errors.Is(err, unix.EPERM) {
+		return nil, ErrNotRoot
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := netns.Set(orig); err != nil {
+		ns.Close()
+		return nil, err
+	}
+
+	n := &Namespace{Link: link, Peer: peer, ns: ns}
+	if n.handle, err = netlink.NewHandleAt(ns); err != nil {
+		ns.Close()
+		return nil, err
+	}
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: link}, PeerName: peer}
+	if err := n.handle.LinkAdd(veth); err != nil {
+		n.Close()
+		return nil, err
+	}
+	for _, name := range []string{link, peer} {
+		l, err := n.handle.LinkByName(name)
+		if err == nil {
+			err = n.handle.LinkSetUp(l)
+		}
+		if err != nil {
+			n.Close()
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// Close removes the namespace, and the veth pair with it.
+func (n *Namespace) Close() error {
+	n.handle.Close()
+	return n.ns.Close()
+}
+
+// Do runs fn in the namespace, e.g. to send ARPs from its interfaces.
+func (n *Namespace) Do(fn func() error) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		return err
+	}
+	defer orig.Close()
+	if err := netns.Set(n.ns); err != nil {
+		return err
+	}
+	defer netns.Set(orig)
+	return fn()
+}
+
+func (n *Namespace) ParseAddr(s string) (*netlink.Addr, error) {
+	return netlink.ParseAddr(s)
+}
+
+func (n *Namespace) LinkByName(name string) (netlink.Link, error) {
+	return n.handle.LinkByName(name)
+}
+
+func (n *Namespace) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	return n.handle.AddrList(link, family)
+}
+
+func (n *Namespace) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	return n.handle.AddrAdd(link, addr)
+}
+
+func (n *Namespace) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	return n.handle.AddrDel(link, addr)
+}
+
+func (n *Namespace) LinkAdd(link netlink.Link) error {
+	return n.handle.LinkAdd(link)
+}
+
+func (n *Namespace) LinkSetUp(link netlink.Link) error {
+	return n.handle.LinkSetUp(link)
+}
+
+func (n *Namespace) LinkSetDown(link netlink.Link) error {
+	return n.handle.LinkSetDown(link)
+}
+
+func (n *Namespace) LinkSetARPOff(link netlink.Link) error {
+	return n.handle.LinkSetARPOff(link)
+}
+
+func (n *Namespace) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	return n.handle.RouteList(link, family)
+}
+
+func (n *Namespace) RouteAdd(route *netlink.Route) error {
+	return n.handle.RouteAdd(route)
+}
+
+func (n *Namespace) RouteDel(route *netlink.Route) error {
+	return n.handle.RouteDel(route)
+}
+
+func (n *Namespace) AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}) error {
+	return netlink.AddrSubscribeWithOptions(ch, done, netlink.AddrSubscribeOptions{Namespace: &n.ns})
+}
+
+func (n *Namespace) LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error {
+	return netlink.LinkSubscribeWithOptions(ch, done, netlink.LinkSubscribeOptions{Namespace: &n.ns})
+}
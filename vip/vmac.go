@@ -0,0 +1,83 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// createVirtual creates Interface as a macvlan interface with VirtualMAC on
+// Parent and brings it up.
+func (m *Manager) createVirtual() (netlink.Link, error) {
+	parent, err := m.linkByName(m.Parent)
+	if err != nil {
+		return nil, err
+	}
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = m.Interface
+	attrs.ParentIndex = parent.Attrs().Index
+	attrs.HardwareAddr = m.VirtualMAC
+	err = m.Netlink.LinkAdd(&netlink.Macvlan{LinkAttrs: attrs, Mode: netlink.MACVLAN_MODE_BRIDGE})
+	// Another instance may have just created it
+	if err != nil && !errors.Is(err, unix.EEXIST) {
+		return nil, err
+	}
+	vlink, err := m.Netlink.LinkByName(m.Interface)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.checkVirtual(vlink); err != nil {
+		return nil, err
+	}
+	if err := m.Netlink.LinkSetUp(vlink); err != nil {
+		return nil, err
+	}
+	m.logger().Infof("Created macvlan interface with MAC %v on %v", m.VirtualMAC, m.Parent)
+	return vlink, nil
+}
+
+// checkVirtual returns an error if vlink, being Interface, doesn't have
+// VirtualMAC.
+func (m *Manager) checkVirtual(vlink netlink.Link) error {
+	if m.VirtualMAC == nil || bytes.Equal(vlink.Attrs().HardwareAddr, m.VirtualMAC) {
+		return nil
+	}
+	return fmt.Errorf("%v has MAC %v instead of the virtual MAC %v", m.Interface, vlink.Attrs().HardwareAddr, m.VirtualMAC)
+}
+
+// disableVirtual brings Interface down once the VIPs are released, so the
+// virtual MAC stops answering here.
+func (m *Manager) disableVirtual() error {
+	vlink, err := m.Netlink.LinkByName(m.Interface)
+	if err != nil {
+		// Never created
+		return nil
+	}
+	if vlink.Attrs().Flags&net.FlagUp == 0 {
+		return nil
+	}
+	if err := m.Netlink.LinkSetDown(vlink); err != nil {
+		m.logger().Errorf("Failed to bring down %v: %v", m.Interface, err)
+		return err
+	}
+	m.logger().Infof("Brought down %v", m.Interface)
+	return nil
+}
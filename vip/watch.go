@@ -0,0 +1,59 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vip
+
+import (
+	"context"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// watchRemovals returns a channel that receives a value when one of the VIPs
+// is removed from any interface, until ctx is cancelled. It returns nil if
+// address changes can't be watched.
+func (m *Manager) watchRemovals(ctx context.Context) <-chan struct{} {
+	updates := make(chan netlink.AddrUpdate)
+	if err := m.Netlink.AddrSubscribe(updates, ctx.Done()); err != nil {
+		m.logger().Warnf("Failed to watch IP address changes: %v", err)
+		return nil
+	}
+	removed := make(chan struct{}, 1)
+	go func() {
+		for u := range updates {
+			if u.NewAddr || !m.isVIP(u.LinkAddress) {
+				continue
+			}
+			m.logger().Debugf("IP address %v removed", u.LinkAddress.String())
+			select {
+			case removed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return removed
+}
+
+// isVIP reports whether ipnet is one of the VIPs.
+func (m *Manager) isVIP(ipnet net.IPNet) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, a := range m.Addrs {
+		if a.IP.Equal(ipnet.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// maxRange caps the addresses -vip-range expands to, so a mistyped prefix
+// like /16 doesn't set tens of thousands of addresses.
+const maxRange = 256
+
+// expandRange returns the addresses in s, a comma separated list of prefixes
+// like 192.168.0.240/28 and ranges like 192.168.0.240-192.168.0.250, each as
+// a /32 or /128 in CIDR notation.
+func expandRange(s string) ([]string, error) {
+	var addrs []string
+	for _, r := range strings.Split(s, ",") {
+		first, last, err := parseRange(strings.TrimSpace(r))
+		if err != nil {
+			return nil, err
+		}
+		bits := 8 * len(first)
+		for ip := first; ; ip = nextIP(ip) {
+			if len(addrs) == maxRange {
+				return nil, fmt.Errorf("%q has more than %d addresses", s, maxRange)
+			}
+			addrs = append(addrs, fmt.Sprintf("%v/%d", ip, bits))
+			if ip.Equal(last) {
+				break
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// parseRange returns the first and last address of r, a prefix or two
+// addresses separated by a dash. A prefix with host bits set is refused
+// rather than widened to the whole network. IPv4 addresses are returned in
+// their 4 byte form.
+func parseRange(r string) (net.IP, net.IP, error) {
+	if strings.Contains(r, "/") {
+		ip, n, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%q is not a prefix, e.g. 192.168.0.240/28", r)
+		}
+		if !ip.Equal(n.IP) {
+			return nil, nil, fmt.Errorf("%q has host bits set, the prefix starts at %v", r, n)
+		}
+		last := make(net.IP, len(n.IP))
+		for i := range n.IP {
+			last[i] = n.IP[i] | ^n.Mask[i]
+		}
+		return n.IP, last, nil
+	}
+	ends := strings.Split(r, "-")
+	if len(ends) != 2 {
+		return nil, nil, fmt.Errorf("%q is not a prefix or a range, e.g. 192.168.0.240-192.168.0.250", r)
+	}
+	first, last := parseIP(strings.TrimSpace(ends[0])), parseIP(strings.TrimSpace(ends[1]))
+	switch {
+	case first == nil || last == nil:
+		return nil, nil, fmt.Errorf("%q is not a range of addresses, e.g. 192.168.0.240-192.168.0.250", r)
+	case len(first) != len(last):
+		return nil, nil, fmt.Errorf("%q mixes IPv4 and IPv6 addresses", r)
+	case bytes.Compare(first, last) > 0:
+		return nil, nil, fmt.Errorf("%q ends before it starts", r)
+	}
+	return first, last, nil
+}
+
+// parseIP is net.ParseIP returning IPv4 addresses in their 4 byte form.
+func parseIP(s string) net.IP {
+	ip := net.ParseIP(s)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// nextIP returns the address after ip.
+func nextIP(ip net.IP) net.IP {
+	next := append(net.IP(nil), ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 retinadata
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandRange(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want []string
+		err  string
+	}{
+		{in: "192.168.0.240/30", want: []string{"192.168.0.240/32", "192.168.0.241/32", "192.168.0.242/32", "192.168.0.243/32"}},
+		{in: "192.168.0.254-192.168.1.1", want: []string{"192.168.0.254/32", "192.168.0.255/32", "192.168.1.0/32", "192.168.1.1/32"}},
+		{in: "fd00::fffe - fd00::1:1", want: []string{"fd00::fffe/128", "fd00::ffff/128", "fd00::1:0/128", "fd00::1:1/128"}},
+		{in: "fd00::10/127", want: []string{"fd00::10/128", "fd00::11/128"}},
+		{in: "192.168.0.5/32", want: []string{"192.168.0.5/32"}},
+		{in: "192.168.0.5-192.168.0.5", want: []string{"192.168.0.5/32"}},
+		{in: "10.0.0.1/32, 10.0.0.8-10.0.0.9", want: []string{"10.0.0.1/32", "10.0.0.8/32", "10.0.0.9/32"}},
+		{in: "192.168.0.243/28", err: "host bits set, the prefix starts at 192.168.0.240/28"},
+		{in: "192.168.0.250-192.168.0.240", err: "ends before it starts"},
+		{in: "192.168.0.240-fd00::1", err: "mixes IPv4 and IPv6"},
+		{in: "192.168.0.5", err: "not a prefix or a range"},
+		{in: "192.168.0.5-", err: "not a range of addresses"},
+		{in: "192.168.0.0/33", err: "not a prefix"},
+		{in: "10.0.0.0/25,10.0.1.0/25,10.0.2.0/32", err: "more than 256 addresses"},
+	} {
+		got, err := expandRange(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expandRange(%q): %v, want an error containing %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expandRange(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestExpandRangeCap(t *testing.T) {
+	// 256 addresses are fine, across several entries too
+	got, err := expandRange("10.0.0.0/25,10.0.1.0/25")
+	if err != nil || len(got) != maxRange {
+		t.Fatalf("expandRange: %d addresses, %v, want %d", len(got), err, maxRange)
+	}
+	if last := got[maxRange-1]; last != "10.0.1.127/32" {
+		t.Errorf("last address %v, want 10.0.1.127/32", last)
+	}
+}
+
+func TestNextIP(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{"192.168.0.1", "192.168.0.2"},
+		{"192.168.0.255", "192.168.1.0"},
+		{"fd00::ffff", "fd00::1:0"},
+	} {
+		if got := nextIP(parseIP(tt.in)); got.String() != tt.want {
+			t.Errorf("nextIP(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}